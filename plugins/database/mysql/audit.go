@@ -0,0 +1,106 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	auditOperationCreate   = "create"
+	auditOperationRevoke   = "revoke"
+	auditOperationRollback = "rollback"
+
+	auditWebhookTimeout = 10 * time.Second
+)
+
+// auditRecord is sent to the audit_webhook_url for every account created or
+// removed by the plugin. It never holds the password.
+type auditRecord struct {
+	Operation string    `json:"operation"`
+	Username  string    `json:"username"`
+	Host      string    `json:"host"`
+	Role      string    `json:"role,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// validateAuditWebhook checks that the audit_webhook_url is an http:// or
+// https:// URL.
+func validateAuditWebhook(rawURL string) error {
+	// The error may contain the password, so it is left out
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid audit_webhook_url, check that reserved characters in the username and password are percent-encoded")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid audit_webhook_url scheme %q, must be one of %q or %q", u.Scheme, "http", "https")
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("invalid audit_webhook_url: missing the host")
+	}
+
+	return nil
+}
+
+// audit sends a record of the operation on each of the users' accounts, one
+// for every grant host, to the audit_webhook_url if one is set. The records
+// are sent in the background, so that a slow or unavailable receiver doesn't
+// hold up the operation, and failures to send them are logged. Close waits for
+// the records still being sent.
+func (m *MySQL) audit(operation, role string, usernames ...string) {
+	if len(m.AuditWebhookURL) == 0 || len(usernames) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	var records []auditRecord
+	for _, username := range usernames {
+		for _, host := range m.grantHosts() {
+			records = append(records, auditRecord{
+				Operation: operation,
+				Username:  username,
+				Host:      host,
+				Role:      role,
+				Time:      now,
+			})
+		}
+	}
+
+	webhookURL, logger := m.AuditWebhookURL, m.logger
+	m.auditWG.Add(1)
+	go func() {
+		defer m.auditWG.Done()
+
+		if err := sendAuditRecords(webhookURL, records); err != nil {
+			logger.Warn("mysql: error sending audit records", "operation", operation, "users", len(usernames), "error", err)
+		}
+	}()
+}
+
+// sendAuditRecords posts the records to the webhook as a JSON array.
+func sendAuditRecords(webhookURL string, records []auditRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: auditWebhookTimeout}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit_webhook_url responded with %s", resp.Status)
+	}
+
+	return nil
+}
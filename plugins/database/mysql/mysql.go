@@ -2,11 +2,25 @@ package mysql
 
 import (
 	"context"
+	"crypto/sha1"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	metrics "github.com/armon/go-metrics"
 	stdmysql "github.com/go-sql-driver/mysql"
+	hclog "github.com/hashicorp/go-hclog"
+	goversion "github.com/hashicorp/go-version"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
 	"github.com/hashicorp/vault/helper/strutil"
@@ -18,31 +32,171 @@ import (
 
 const (
 	defaultMysqlRevocationStmts = `
-		REVOKE ALL PRIVILEGES, GRANT OPTION FROM '{{name}}'@'%'; 
-		DROP USER '{{name}}'@'%'
+		REVOKE ALL PRIVILEGES, GRANT OPTION FROM '{{name}}'@'{{host}}'; 
+		DROP USER '{{name}}'@'{{host}}'
 	`
-	mySQLTypeName = "mysql"
+	defaultMysqlDisableStmts = `
+		REVOKE ALL PRIVILEGES, GRANT OPTION FROM '{{name}}'@'{{host}}'; 
+		ALTER USER '{{name}}'@'{{host}}' ACCOUNT LOCK
+	`
+	defaultMysqlRotationStmts = `
+		ALTER USER '{{name}}'@'{{host}}' IDENTIFIED BY '{{password}}'
+	`
+	defaultMysqlHashedRotationStmts = `
+		ALTER USER '{{name}}'@'{{host}}' IDENTIFIED WITH mysql_native_password AS '{{password_hash}}'
+	`
+	defaultMysqlRenewExpirationStmts = `
+		ALTER USER '{{name}}'@'{{host}}' PASSWORD EXPIRE INTERVAL {{expiration}} DAY
+	`
+	defaultRolesStmt  = `ALTER USER '{{name}}'@'{{host}}' DEFAULT ROLE ALL`
+	alterUserStmt     = `ALTER USER '{{name}}'@'{{host}}'`
+	resourceGroupStmt = `GRANT RESOURCE_GROUP_USER ON *.* TO '{{name}}'@'{{host}}'`
+	mySQLTypeName     = "mysql"
+
+	retryBackoff = 100 * time.Millisecond
+
+	// resetTimeout bounds restoring session state on a pooled connection once
+	// the operation, whose context may have expired, has finished.
+	resetTimeout = 5 * time.Second
+
+	// connectionRetries is the number of times establishing a connection is
+	// retried, with exponential backoff, when the server can't be reached.
+	connectionRetries = 5
+
+	flavorMySQL   = "mysql"
+	flavorMariaDB = "mariadb"
+
+	// The schemes returned by UsernameScheme. Usernames generated with the
+	// current scheme are marked with currentUsernameMarker.
+	UsernameSchemeLegacy  = "legacy"
+	UsernameSchemeCurrent = "current"
+	currentUsernameMarker = "2"
+
+	// Placeholder credentials used when validating creation statements.
+	validationUsername = "vault-validation"
+	validationPassword = "vault-validation-password"
+
+	// noPrepareMarker is a leading comment marking a statement to be executed
+	// directly rather than as a prepared statement, for commands that can't
+	// be prepared.
+	noPrepareMarker = "-- +no-prepare"
+
+	// redactedPassword replaces the password in the statements returned by
+	// DryRunCreateUser and in errors.
+	redactedPassword = "<redacted>"
 )
 
 var (
-	MetadataLen       int = 10
-	LegacyMetadataLen int = 4
-	UsernameLen       int = 32
-	LegacyUsernameLen int = 16
+	createUserRe     = regexp.MustCompile(`(?i)^CREATE\s+USER`)
+	identifiedByRe   = regexp.MustCompile(`(?i)\bIDENTIFIED\s+BY\b`)
+	identifiedWithRe = regexp.MustCompile(`(?i)\bIDENTIFIED\s+WITH\b`)
+	identifiedViaRe  = regexp.MustCompile(`(?i)\bIDENTIFIED\s+VIA\b`)
+	passwordRe       = regexp.MustCompile(`(?i)\bIDENTIFIED\s+BY\s+('(?:[^'\\]|''|\\.)*')`)
+	grantRe          = regexp.MustCompile(`(?i)^GRANT\s`)
+	grantOnRe        = regexp.MustCompile(`(?i)\sON\s`)
+	grantToRe        = regexp.MustCompile(`(?i)\sTO\s`)
+	selectRe         = regexp.MustCompile(`(?i)^SELECT\s`)
+	grantProxyRe     = regexp.MustCompile(`(?i)^GRANT\s+PROXY\s+ON\s`)
+	defaultRoleRe    = regexp.MustCompile(`(?i)\bDEFAULT\s+ROLE\b`)
+	requireRe        = regexp.MustCompile(`(?is)^(CREATE|ALTER)\s+USER\b.*\bREQUIRE\s`)
+
+	// errorPasswordRe matches the password or hash in a statement echoed back
+	// in an error. The server truncates the statement, so the closing quote
+	// may be missing.
+	errorPasswordRe = regexp.MustCompile(`(?i)(\bIDENTIFIED(?:\s+WITH\s+\S+)?\s+(?:BY|AS)(?:\s+PASSWORD)?\s*|\bPASSWORD\s*\(\s*)'(?:[^'\\]|''|\\.)*(?:'|$)`)
+
+	// valueEscaper escapes values for use within single quoted string
+	// literals. Quotes are doubled rather than backslash escaped so they are
+	// handled the same with the NO_BACKSLASH_ESCAPES SQL mode.
+	valueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `''`)
+
+	// hostPlaceholderRe matches {{host}}, including when a template function
+	// is applied to it.
+	hostPlaceholderRe = regexp.MustCompile(`\{\{host(?:\s*\|\s*\w+\s*)?\}\}`)
+
+	// passwordPlaceholderRe matches {{password}}, including when a template
+	// function is applied to it.
+	passwordPlaceholderRe = regexp.MustCompile(`\{\{password(?:\s*\|\s*\w+\s*)?\}\}`)
+
+	// accountRe matches a 'user'@'host' account name in a statement.
+	accountRe = regexp.MustCompile(`'((?:[^'\\]|''|\\.)*)'@'((?:[^'\\]|''|\\.)*)'`)
+
+	// templateFuncs are the functions that can be applied to values in the
+	// statements, such as GRANT SELECT ON {{name | quoteIdentifier}}.* for a
+	// database named after the user.
+	templateFuncs = dbutil.QueryFuncs{
+		"quoteIdentifier": quoteIdentifier,
+		"quoteLiteral": func(v string) string {
+			return "'" + valueEscaper.Replace(v) + "'"
+		},
+	}
+
+	// likeEscaper escapes the wildcards in LIKE patterns.
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+	// mariaDBAuthPlugins are the authentication plugins that MySQL doesn't
+	// provide, or provides under a different name.
+	mariaDBAuthPlugins = map[string]bool{
+		"ed25519":     true,
+		"gssapi":      true,
+		"pam":         true,
+		"unix_socket": true,
+	}
+
+	// accountMetadataVersion is the first MySQL version supporting account
+	// comments and attributes.
+	accountMetadataVersion = goversion.Must(goversion.NewVersion("8.0.21"))
+
+	// resourceGroupVersion is the first MySQL version supporting resource
+	// groups.
+	resourceGroupVersion = goversion.Must(goversion.NewVersion("8.0.3"))
+)
+
+// The default lengths of display names, role names and usernames, which are
+// set per instance by New and may be overridden by the configuration.
+const (
+	MetadataLen       = 10
+	LegacyMetadataLen = 4
+	UsernameLen       = 32
+	LegacyUsernameLen = 16
 )
 
 var _ dbplugin.Database = &MySQL{}
 
 type MySQL struct {
-	connutil.ConnectionProducer
+	*mySQLConnectionProducer
 	credsutil.CredentialsProducer
+
+	// version is the version reported by the server, it is looked up once.
+	version string
+
+	// unpreparable holds the statement templates the server has refused to
+	// prepare, which are executed directly from then on. It is reset along
+	// with the version.
+	unpreparable map[string]bool
+
+	// stateLock guards version and unpreparable, and connLock guards opening
+	// the connection pool, as CreateUser only holds the connection
+	// producer's lock for reading.
+	stateLock sync.Mutex
+	connLock  sync.Mutex
+
+	// auditWG tracks the audit records still being sent.
+	auditWG sync.WaitGroup
+
+	// logger never receives passwords or the rendered statements, which
+	// contain the generated credentials.
+	logger hclog.Logger
 }
 
 // New implements builtinplugins.BuiltinFactory
 func New(displayNameLen, roleNameLen, usernameLen int) func() (interface{}, error) {
 	return func() (interface{}, error) {
-		connProducer := &connutil.SQLConnectionProducer{}
+		connProducer := &mySQLConnectionProducer{
+			SQLConnectionProducer: &connutil.SQLConnectionProducer{},
+		}
 		connProducer.Type = mySQLTypeName
+		connProducer.Connector = &mySQLConnector{producer: connProducer}
 
 		credsProducer := &credsutil.SQLCredentialsProducer{
 			DisplayNameLen: displayNameLen,
@@ -50,16 +204,48 @@ func New(displayNameLen, roleNameLen, usernameLen int) func() (interface{}, erro
 			UsernameLen:    usernameLen,
 			Separator:      "-",
 		}
+		// Legacy usernames are left as they always were
+		if usernameLen > LegacyUsernameLen {
+			credsProducer.UsernameMarker = currentUsernameMarker
+		}
 
 		dbType := &MySQL{
-			ConnectionProducer:  connProducer,
-			CredentialsProducer: credsProducer,
+			mySQLConnectionProducer: connProducer,
+			CredentialsProducer:     credsProducer,
+			logger:                  hclog.New(&hclog.LoggerOptions{Output: ioutil.Discard}),
 		}
 
 		return dbType, nil
 	}
 }
 
+// UsernameScheme returns which scheme a username generated by this plugin was
+// issued under, UsernameSchemeLegacy for the short usernames of the legacy,
+// Aurora and RDS plugins or UsernameSchemeCurrent otherwise. An empty string
+// is returned if the username wasn't generated by Vault, or was rendered from
+// a username_template.
+func (m *MySQL) UsernameScheme(username string) string {
+	separator := "-"
+	scp, ok := m.CredentialsProducer.(*credsutil.SQLCredentialsProducer)
+	if ok {
+		username = strings.TrimPrefix(username, scp.UsernamePrefix)
+		separator = scp.Separator
+	}
+
+	switch {
+	case strings.HasPrefix(username, "v"+currentUsernameMarker+separator):
+		return UsernameSchemeCurrent
+	case !strings.HasPrefix(username, "v"+separator):
+		return ""
+	// Usernames issued before the marker was added are told apart by their
+	// length, as they are always truncated
+	case len(username) <= LegacyUsernameLen:
+		return UsernameSchemeLegacy
+	default:
+		return UsernameSchemeCurrent
+	}
+}
+
 // Run instantiates a MySQL object, and runs the RPC server for the plugin
 func Run(apiTLSConfig *api.TLSConfig) error {
 	return runCommon(false, apiTLSConfig)
@@ -87,150 +273,2377 @@ func runCommon(legacy bool, apiTLSConfig *api.TLSConfig) error {
 	return nil
 }
 
+// SetLogger sets the logger used for debugging output.
+func (m *MySQL) SetLogger(logger hclog.Logger) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.logger = logger
+}
+
 func (m *MySQL) Type() (string, error) {
 	return mySQLTypeName, nil
 }
 
-func (m *MySQL) getConnection(ctx context.Context) (*sql.DB, error) {
-	db, err := m.Connection(ctx)
+// Initialize parses the credentials settings out of the configuration and
+// initializes the connection producer.
+func (m *MySQL) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	// The credentials producer is read by CreateUser while it holds the
+	// connection producer's lock for reading.
+	scp, ok := m.CredentialsProducer.(*credsutil.SQLCredentialsProducer)
+	if ok {
+		m.Lock()
+		err := scp.Configure(conf)
+		m.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The connection is verified below so the failure can be classified.
+	if err := m.mySQLConnectionProducer.Initialize(ctx, conf, false); err != nil {
+		return err
+	}
+
+	// The default renew statement sets the expiry as a number of days
+	if m.RenewPasswordExpiration && (!ok || scp.ExpirationFormat != credsutil.ExpirationFormatDays) {
+		return fmt.Errorf("renew_password_expiration requires expiration_format to be %q", credsutil.ExpirationFormatDays)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	// The server may have changed along with the configuration.
+	m.version = ""
+	m.unpreparable = nil
+
+	if verifyConnection {
+		if err := m.verifyConnection(ctx); err != nil {
+			return err
+		}
+
+		db, err := m.getConnection(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+			if _, err := m.serverVersion(ctx, conn); err != nil {
+				return fmt.Errorf("error detecting server version: %s", err)
+			}
+
+			return m.checkResourceGroup(ctx, conn)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := m.warmUp(ctx, db, m.MinConnections); err != nil {
+			return fmt.Errorf("error opening min_connections: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// warmUp opens connections until the pool has the given number of them, which
+// are then returned to it as idle connections.
+func (m *MySQL) warmUp(ctx context.Context, db *sql.DB, connections int) error {
+	conns := make([]*sql.Conn, 0, connections)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	// Hold on to each connection so that the next one is a new connection
+	// rather than an idle one
+	for len(conns) < connections {
+		conn, err := m.acquireConn(ctx, db)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	return nil
+}
+
+// Close closes the connection pools, and any connections in use are closed
+// once they are returned to them. The plugin can be initialized again
+// afterwards, which opens new connections with the new configuration.
+func (m *MySQL) Close() error {
+	if err := m.mySQLConnectionProducer.Close(); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.auditWG.Wait()
+
+	m.version = ""
+	m.unpreparable = nil
+
+	return nil
+}
+
+// VerifyConnection checks that the server can be reached and logged into
+// with the configured credentials, without making any changes. The returned
+// error is a *NetworkError, *AuthError or *PermissionError depending on why
+// the connection failed.
+func (m *MySQL) VerifyConnection(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.verifyConnection(ctx)
+}
+
+func (m *MySQL) verifyConnection(ctx context.Context) error {
+	db, err := m.getConnection(ctx)
+	if err == nil {
+		err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+			if err := conn.PingContext(ctx); err != nil {
+				return err
+			}
+
+			var one int
+			return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+		})
+	}
+
+	return classifyConnectionError(err)
+}
+
+// Flavor returns the flavor of the server, either "mysql" or "mariadb".
+func (m *MySQL) Flavor(ctx context.Context) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	db, err := m.getConnection(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	var version string
+	err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+		version, err = m.serverVersion(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return db.(*sql.DB), nil
+	return flavor(version), nil
 }
 
-func (m *MySQL) CreateUser(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, expiration time.Time) (username string, password string, err error) {
-	// Grab the lock
+// PoolStats returns the statistics of the primary connection pool.
+func (m *MySQL) PoolStats(ctx context.Context) (sql.DBStats, error) {
 	m.Lock()
 	defer m.Unlock()
 
-	// Get the connection
 	db, err := m.getConnection(ctx)
 	if err != nil {
-		return "", "", err
+		return sql.DBStats{}, err
+	}
+
+	return db.Stats(), nil
+}
+
+// getConnection returns the connection pool shared by all operations. The
+// pool is only replaced when it stops responding.
+func (m *MySQL) getConnection(ctx context.Context) (*sql.DB, error) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := m.Connection(ctx)
+		if err == nil {
+			db, ok := conn.(*sql.DB)
+			if !ok {
+				return nil, fmt.Errorf("connection producer returned %T instead of *sql.DB", conn)
+			}
+			emitPoolMetrics("pool", db)
+			return db, nil
+		}
+
+		// The server may be restarting or failing over, so keep trying to
+		// reconnect for a while before failing the operation.
+		if attempt >= connectionRetries || !isReconnectableError(err) {
+			return nil, err
+		}
+		m.logger.Debug("mysql: connection failed, reconnecting", "attempt", attempt+1, "backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// getReadConnection returns the connection pool used for read only lookups.
+// It connects to the read_connection_url if one is set, and is otherwise the
+// same as the primary connection.
+func (m *MySQL) getReadConnection(ctx context.Context) (*sql.DB, error) {
+	if m.ReadConnectionURL == "" {
+		return m.getConnection(ctx)
+	}
+
+	// CreateUser only holds the read lock while waiting for the replica
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	if m.readDB == nil {
+		db := sql.OpenDB(&mySQLConnector{producer: m.mySQLConnectionProducer, read: true})
+		m.ConfigurePool(db)
+		m.readDB = db
 	}
+	emitPoolMetrics("read_pool", m.readDB)
+
+	return m.readDB, nil
+}
+
+func (m *MySQL) CreateUser(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	username, password, _, err = m.createUser(ctx, statements, usernameConfig, "", expiration, false)
+	return username, password, err
+}
+
+// CreateUserWithPosition creates a user like CreateUser, and additionally
+// returns the replication position at which the user was created. Clients
+// reading from replicas can wait for the position to be applied before using
+// the credentials.
+func (m *MySQL) CreateUserWithPosition(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, expiration time.Time) (username string, password string, position *ReplicationPosition, err error) {
+	return m.createUser(ctx, statements, usernameConfig, "", expiration, true)
+}
+
+// CreateUserWithUsername creates a user like CreateUser, but with the
+// provided username instead of a generated one, so that accounts can be
+// correlated with identities outside of Vault. The username is truncated to
+// the plugin's username length and must only contain letters, digits, '_',
+// '.' and '-'.
+func (m *MySQL) CreateUserWithUsername(ctx context.Context, statements dbplugin.Statements, username string, expiration time.Time) (password string, err error) {
+	scp, ok := m.CredentialsProducer.(*credsutil.SQLCredentialsProducer)
+	if !ok {
+		return "", fmt.Errorf("credentials producer does not support caller supplied usernames")
+	}
+
+	username, err = scp.ValidateUsername(username)
+	if err != nil {
+		return "", err
+	}
+
+	_, password, _, err = m.createUser(ctx, statements, dbplugin.UsernameConfig{}, username, expiration, false)
+	return password, err
+}
+
+// DryRunCreateUser renders the statements CreateUser would run, including the
+// ones added for the plugin's configuration, without running them, so that
+// they can be reviewed before a role is used. The password is redacted from
+// the statements. The server is still connected to, as the rendering depends
+// on its version.
+func (m *MySQL) DryRunCreateUser(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, expiration time.Time) (username string, queries []string, err error) {
+	// Grab the read lock
+	m.RLock()
+	defer m.RUnlock()
 
+	statements = m.withDefaultCreationStatements(statements)
 	if statements.CreationStatements == "" {
-		return "", "", dbutil.ErrEmptyCreationStatement
+		return "", nil, dbutil.ErrEmptyCreationStatement
 	}
 
-	username, err = m.GenerateUsername(usernameConfig)
+	// Get the connection
+	db, err := m.getConnection(ctx)
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 
-	password, err = m.GeneratePassword()
+	username, err = m.GenerateUsername(usernameConfig)
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 
-	expirationStr, err := m.GenerateExpiration(expiration)
+	password, err := m.GeneratePassword()
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 
-	// Start a transaction
-	tx, err := db.BeginTx(ctx, nil)
+	expirationStr, err := m.GenerateExpiration(expiration)
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
-	defer tx.Rollback()
 
-	// Execute each query
-	for _, query := range strutil.ParseArbitraryStringSlice(statements.CreationStatements, ";") {
-		query = strings.TrimSpace(query)
-		if len(query) == 0 {
-			continue
+	var tpls []string
+	var data map[string]string
+	err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+		tpls, data, err = m.creationStatements(ctx, conn, statements, usernameConfig, username, password, expirationStr)
+		if err != nil {
+			return err
 		}
-		query = dbutil.QueryHelper(query, map[string]string{
-			"name":       username,
-			"password":   password,
-			"expiration": expirationStr,
-		})
 
-		stmt, err := tx.PrepareContext(ctx, query)
-		if err != nil {
-			// If the error code we get back is Error 1295: This command is not
-			// supported in the prepared statement protocol yet, we will execute
-			// the statement without preparing it. This allows the caller to
-			// manually prepare statements, as well as run other not yet
-			// prepare supported commands. If there is no error when running we
-			// will continue to the next statement.
-			if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1295 {
-				_, err = tx.ExecContext(ctx, query)
-				if err != nil {
-					return "", "", err
-				}
+		for i, tpl := range tpls {
+			tpl = strings.TrimSpace(tpl)
+			if len(tpl) == 0 {
 				continue
 			}
 
-			return "", "", err
+			tpls[i], err = m.withAuthPlugin(ctx, conn, tpl)
+			if err != nil {
+				return err
+			}
 		}
-		defer stmt.Close()
-		if _, err := stmt.ExecContext(ctx); err != nil {
-			return "", "", err
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, key := range []string{"password", "password_hash"} {
+		if _, ok := data[key]; ok {
+			data[key] = redactedPassword
 		}
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return "", "", err
+	if m.CreateDatabase != "" {
+		queries = append(queries, renderStatement(createDatabaseStmt, data))
 	}
 
-	return username, password, nil
-}
+	for _, tpl := range tpls {
+		tpl = strings.TrimSpace(tpl)
+		if len(tpl) == 0 {
+			continue
+		}
+		queries = append(queries, renderStatement(tpl, data))
+	}
 
-// NOOP
-func (m *MySQL) RenewUser(ctx context.Context, statements dbplugin.Statements, username string, expiration time.Time) error {
-	return nil
+	return username, queries, nil
 }
 
-func (m *MySQL) RevokeUser(ctx context.Context, statements dbplugin.Statements, username string) error {
-	// Grab the read lock
-	m.Lock()
-	defer m.Unlock()
+// createUser creates a user, with the provided username or a generated one if
+// it is empty.
+func (m *MySQL) createUser(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, username string, expiration time.Time, withPosition bool) (_ string, password string, position *ReplicationPosition, err error) {
+	defer func(now time.Time) {
+		emitMetrics("CreateUser", now, err)
+		err = wrapConfigError(classifyError(err))
+	}(time.Now())
 
-	// Get the connection
-	db, err := m.getConnection(ctx)
+	// Grab the read lock, so that up to max_concurrent_creates users can be
+	// created at once while the configuration can't change
+	m.RLock()
+	defer m.RUnlock()
+
+	// Get the connection, to a single server for all of the statements
+	db, connURL, err := m.getPrimaryConnection(ctx)
 	if err != nil {
-		return err
+		return "", "", nil, err
 	}
 
-	revocationStmts := statements.RevocationStatements
-	// Use a default SQL statement for revocation if one cannot be fetched from the role
-	if revocationStmts == "" {
-		revocationStmts = defaultMysqlRevocationStmts
+	select {
+	case m.createSem <- struct{}{}:
+		defer func() { <-m.createSem }()
+	case <-ctx.Done():
+		return "", "", nil, ctx.Err()
 	}
 
-	// Start a transaction
-	tx, err := db.BeginTx(ctx, nil)
+	statements = m.withDefaultCreationStatements(statements)
+	if statements.CreationStatements == "" {
+		return "", "", nil, dbutil.ErrEmptyCreationStatement
+	}
+
+	if m.CheckCapacity {
+		err := m.withConn(ctx, db, func(conn *sql.Conn) error {
+			return checkCapacity(ctx, conn)
+		})
+		if err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	if username == "" {
+		username, err = m.GenerateUsername(usernameConfig)
+		if err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	password, err = m.GeneratePassword()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	expirationStr, err := m.GenerateExpiration(expiration)
 	if err != nil {
+		return "", "", nil, err
+	}
+
+	var queries []string
+	var data map[string]string
+	err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+		queries, data, err = m.creationStatements(ctx, conn, statements, usernameConfig, username, password, expirationStr)
 		return err
+	})
+	if err != nil {
+		return "", "", nil, err
 	}
-	defer tx.Rollback()
 
-	for _, query := range strutil.ParseArbitraryStringSlice(revocationStmts, ";") {
-		query = strings.TrimSpace(query)
-		if len(query) == 0 {
-			continue
+	var userCreated bool
+	if m.CreateDatabase != "" {
+		if err := m.createDatabase(ctx, db, data); err != nil {
+			return "", "", nil, err
 		}
 
-		// This is not a prepared statement because not all commands are supported
-		// 1295: This command is not supported in the prepared statement protocol yet
-		// Reference https://mariadb.com/kb/en/mariadb/prepare-statement/
-		query = strings.Replace(query, "{{name}}", username, -1)
-		_, err = tx.ExecContext(ctx, query)
+		// The database is of no use without the user, so it is dropped if
+		// the user isn't created
+		defer func() {
+			if err == nil || userCreated {
+				return
+			}
+			if dropErr := m.dropDatabase(ctx, db, username); dropErr != nil {
+				err = fmt.Errorf("%s, and its database could not be dropped: %s", err, dropErr)
+			}
+		}()
+	}
+
+	if err := m.executeCreation(ctx, db, queries, data); err != nil {
+		return "", "", nil, err
+	}
+
+	// Catch creation statements that grant to the user without creating it,
+	// or that create it with a different name or host, as the credentials
+	// would not be usable.
+	if m.VerifyCreation {
+		err := m.withConn(ctx, db, func(conn *sql.Conn) error {
+			return m.verifyUserCreated(ctx, conn, username)
+		})
 		if err != nil {
+			if rollbackErr := m.rollbackCreatedUser(ctx, db, statements, queries, data, username); rollbackErr != nil {
+				return "", "", nil, fmt.Errorf("%s, and the user could not be rolled back: %s", err, rollbackErr)
+			}
+			return "", "", nil, fmt.Errorf("%s, the user was rolled back", err)
+		}
+	}
+
+	// The credentials would not work as expected, so the user isn't left
+	// behind
+	if m.VerifyGrant != "" {
+		if err := m.verifyGrant(ctx, connURL, username, password); err != nil {
+			if revokeErr := m.revokeUser(ctx, db, m.revocationStatements(statements), username); revokeErr != nil {
+				return "", "", nil, fmt.Errorf("verify_grant failed: %s, and the user could not be revoked: %s", err, revokeErr)
+			}
+			return "", "", nil, fmt.Errorf("verify_grant failed, the user was revoked: %s", err)
+		}
+	}
+
+	// Errors from here on leave the user in place
+	userCreated = true
+
+	if withPosition || m.replicaWait > 0 {
+		err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+			position, err = m.replicationPosition(ctx, conn)
 			return err
+		})
+		if err != nil {
+			return "", "", nil, fmt.Errorf("user was created but its replication position could not be read: %s", err)
 		}
+	}
 
+	if m.replicaWait > 0 {
+		if err := m.waitForReplica(ctx, db, position); err != nil {
+			return "", "", nil, fmt.Errorf("user was created but was not replicated to the read_connection_url: %s", err)
+		}
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return err
+	m.audit(auditOperationCreate, usernameConfig.RoleName, username)
+
+	return username, password, position, nil
+}
+
+// executeCreation runs the creation statements, within a transaction that is
+// retried as a whole if it fails on a transient error, or directly on a
+// connection when use_transaction is disabled. The latter are never retried,
+// as the statements that succeeded before the failure aren't undone and would
+// be run again.
+func (m *MySQL) executeCreation(ctx context.Context, db *sql.DB, queries []string, data map[string]string) error {
+	if m.UseTransaction != nil && !*m.UseTransaction {
+		return m.executeWithoutTransaction(ctx, db, queries, data)
 	}
 
-	return nil
+	return m.retryTransaction(ctx, func() error {
+		return m.executeTransaction(ctx, db, queries, data)
+	})
+}
+
+// withDefaultCreationStatements returns the statements with the
+// default_creation_statements in place of empty creation statements.
+func (m *MySQL) withDefaultCreationStatements(statements dbplugin.Statements) dbplugin.Statements {
+	if statements.CreationStatements == "" {
+		statements.CreationStatements = m.DefaultCreationStatements
+	}
+
+	return statements
+}
+
+// creationStatements returns the statements that create the user, including
+// the ones added for the plugin's configuration, and the template data to
+// render them with.
+func (m *MySQL) creationStatements(ctx context.Context, q rowQueryer, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, username, password, expirationStr string) ([]string, map[string]string, error) {
+	queries := strutil.ParseArbitraryStringSlice(statements.CreationStatements, ";")
+	if err := m.checkAllowedStatements(queries); err != nil {
+		return nil, nil, err
+	}
+
+	// Roles granted to the user are not active on login unless they are set
+	// as the user's default roles
+	if grantsRoles(queries) {
+		queries = append(queries, defaultRolesStmt)
+	}
+
+	if m.ResourceLimits != nil {
+		if clause := m.ResourceLimits.clause(); clause != "" {
+			queries = append(queries, alterUserStmt+" "+clause)
+		}
+	}
+
+	queries = append(queries, m.proxyGrantStmts...)
+
+	if m.CreateDatabase != "" {
+		queries = append(queries, databaseGrantStmt)
+	}
+
+	if m.ResourceGroup != "" {
+		version, err := m.serverVersion(ctx, q)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !supportsResourceGroups(version) {
+			return nil, nil, fmt.Errorf("resource_group requires MySQL %s or later, the server is %s", resourceGroupVersion, version)
+		}
+		queries = append(queries, resourceGroupStmt)
+	}
+
+	// Creation statements that set their own requirements take precedence
+	if clause := m.requireClause(); clause != "" && !setsRequire(queries) {
+		queries = append(queries, alterUserStmt+" "+clause)
+	}
+
+	data, err := m.withPasswordHash(statements.CreationStatements, map[string]string{
+		"name":       username,
+		"host":       m.Host,
+		"password":   password,
+		"expiration": expirationStr,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.CreateDatabase != "" {
+		data["database"], err = m.databaseName(username)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	metadataStmts, err := m.accountMetadataStmts(ctx, q, data, map[string]string{
+		"name":         username,
+		"display_name": usernameConfig.DisplayName,
+		"role_name":    usernameConfig.RoleName,
+		"expiration":   expirationStr,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	queries = append(queries, metadataStmts...)
+
+	if m.FlushPrivilegesOnCreate {
+		queries = append(queries, "FLUSH PRIVILEGES")
+	}
+
+	return m.expandHosts(queries), data, nil
+}
+
+// checkAllowedStatements returns an error if any of the creation statements
+// runs a command that isn't in allowed_statements.
+func (m *MySQL) checkAllowedStatements(queries []string) error {
+	if len(m.AllowedStatements) == 0 {
+		return nil
+	}
+
+	for _, query := range queries {
+		query, _ = stripNoPrepare(query)
+		if len(query) == 0 {
+			continue
+		}
+
+		// Only the leading command is compared, so statements starting with
+		// a comment, which may contain executable SQL, are never allowed
+		normalized := strings.ToUpper(strings.Join(strings.Fields(query), " ")) + " "
+		allowed := false
+		for _, command := range m.AllowedStatements {
+			if strings.HasPrefix(normalized, command+" ") {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("creation statement %q is not permitted by allowed_statements", query)
+		}
+	}
+
+	return nil
+}
+
+// verifyUserCreated returns an error if the user doesn't exist at the
+// configured host. The check is skipped if the connection user can't read
+// mysql.user, as that was not needed to create users before.
+func (m *MySQL) verifyUserCreated(ctx context.Context, q rowQueryer, username string) error {
+	for _, host := range m.grantHosts() {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM mysql.user WHERE User = ? AND Host = ?)", username, host).Scan(&exists)
+		// Error 1142: Command denied to user for table
+		if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1142 {
+			m.logger.Debug("mysql: can't read mysql.user, not verifying the user was created", "error", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return fmt.Errorf("creation statements did not create user '%s'@'%s', check that they create {{name}}@{{host}}", username, host)
+		}
+	}
+
+	return nil
+}
+
+// verifyUserRevoked returns an error if the user still exists for any of the
+// grant hosts.
+func (m *MySQL) verifyUserRevoked(ctx context.Context, q rowQueryer, username string) error {
+	for _, host := range m.grantHosts() {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM mysql.user WHERE User = ? AND Host = ?)", username, host).Scan(&exists)
+		// Error 1142: Command denied to user for table
+		if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1142 {
+			return fmt.Errorf("verify_revocation requires the user Vault connects as to be able to read mysql.user: %s", err)
+		}
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return fmt.Errorf("revocation statements did not drop user '%s'@'%s', check that they drop {{name}}@{{host}}", username, host)
+		}
+	}
+
+	return nil
+}
+
+// verifyGrant runs the verify_grant query as the user, on a connection of its
+// own to the server at the connection URL the user was created on.
+func (m *MySQL) verifyGrant(ctx context.Context, connURL, username, password string) error {
+	dsn, err := m.dsn(connURL)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := parseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	cfg.User = username
+	cfg.Passwd = password
+	cfg.AllowCleartextPasswords = false
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, m.VerifyGrant)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+
+	return rows.Err()
+}
+
+// grantHosts returns the hosts users are created for.
+func (m *MySQL) grantHosts() []string {
+	if len(m.GrantHosts) > 0 {
+		return m.GrantHosts
+	}
+
+	return []string{m.Host}
+}
+
+// expandHosts repeats each of the queries that template {{host}} for every
+// grant host, with the host rendered in, so that the user is set up, or torn
+// down, the same way for each of them. Queries that don't template the host
+// are kept once, in their place.
+func (m *MySQL) expandHosts(queries []string) []string {
+	hosts := m.grantHosts()
+	if len(hosts) == 1 {
+		return queries
+	}
+
+	var expanded []string
+	for _, query := range queries {
+		if !hostPlaceholderRe.MatchString(query) {
+			expanded = append(expanded, query)
+			continue
+		}
+
+		for _, host := range hosts {
+			expanded = append(expanded, renderStatement(query, map[string]string{"host": host}))
+		}
+	}
+
+	return expanded
+}
+
+// SetCredentials generates a new password for an existing user and sets it by
+// running the rotation statements, or the configured rotation_statements, or
+// a default ALTER USER statement if neither are provided. This allows static roles to rotate the password of an account
+// with a fixed username, including shared accounts Vault doesn't connect as.
+// The open connections are left as they are. The account Vault connects as
+// can't be rotated, as the connection_url would keep the old password.
+func (m *MySQL) SetCredentials(ctx context.Context, rotationStatements string, username string) (password string, err error) {
+	defer func(now time.Time) {
+		emitMetrics("SetCredentials", now, err)
+		err = wrapConfigError(classifyError(err))
+	}(time.Now())
+
+	if username == "" {
+		return "", fmt.Errorf("username cannot be empty")
+	}
+
+	if err := checkRotationStatements(rotationStatements); err != nil {
+		return "", err
+	}
+
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	rotationStatements = m.rotationStatements(rotationStatements)
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var user, host string
+	err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+		user, host, err = connectionUser(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if user == username && strutil.StrListContains(m.grantHosts(), host) {
+		return "", fmt.Errorf("cannot rotate the password of '%s'@'%s', the user Vault connects as", username, host)
+	}
+
+	password, err = m.GeneratePassword()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := m.withPasswordHash(rotationStatements, map[string]string{
+		"name":     username,
+		"host":     m.Host,
+		"password": password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = m.retryTransaction(ctx, func() error {
+		return m.executeTransaction(ctx, db, m.expandHosts(strutil.ParseArbitraryStringSlice(rotationStatements, ";")), data)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// rotationStatements returns the given rotation statements, or the
+// rotation_statements, or the default statement for the password_hashing if
+// neither are set.
+func (m *MySQL) rotationStatements(rotationStatements string) string {
+	switch {
+	case rotationStatements != "":
+		return rotationStatements
+	case m.RotationStatements != "":
+		return m.RotationStatements
+	case m.PasswordHashing == passwordHashingClient:
+		return defaultMysqlHashedRotationStmts
+	default:
+		return defaultMysqlRotationStmts
+	}
+}
+
+// checkRotationStatements returns an error if any of the rotation statements
+// create a user, as rotation only changes the password of an existing one.
+func checkRotationStatements(rotationStatements string) error {
+	for _, query := range strutil.ParseArbitraryStringSlice(rotationStatements, ";") {
+		query, _ = stripNoPrepare(query)
+		if createUserRe.MatchString(query) {
+			return fmt.Errorf("rotation statements must alter an existing user, not create one: %q", query)
+		}
+	}
+
+	return nil
+}
+
+// connectionUser returns the user and host of the account the connection is
+// authenticated as.
+func connectionUser(ctx context.Context, q rowQueryer) (user, host string, err error) {
+	var account string
+	if err := q.QueryRowContext(ctx, "SELECT CURRENT_USER()").Scan(&account); err != nil {
+		return "", "", err
+	}
+
+	// The user name may itself contain an '@', the host can't
+	i := strings.LastIndex(account, "@")
+	if i < 0 {
+		return account, "", nil
+	}
+
+	return account[:i], account[i+1:], nil
+}
+
+// UserExists returns true if an account with the username exists for the host,
+// or for any host if it is empty, so that callers supplying usernames can
+// avoid clashing with accounts managed outside of Vault.
+func (m *MySQL) UserExists(ctx context.Context, username, host string) (bool, error) {
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM mysql.user WHERE User = ? AND (? = '' OR Host = ?))", username, host, host).Scan(&exists)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// PasswordExpiration returns when the server will expire the user's password,
+// taking into account a PASSWORD EXPIRE INTERVAL set by the creation
+// statements or the server's default_password_lifetime. This allows the lease
+// TTL to be aligned with the expiry the server actually enforces. With
+// grant_hosts the earliest expiry of the user on any of them is returned. A
+// zero time is returned if the password never expires.
+func (m *MySQL) PasswordExpiration(ctx context.Context, username string) (time.Time, error) {
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	hosts := m.grantHosts()
+	args := []interface{}{username}
+	for _, host := range hosts {
+		args = append(args, host)
+	}
+
+	// The user is created for each of the grant hosts, and its password
+	// expires on the first of them to expire it
+	var expiration time.Time
+	err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `
+			SELECT UNIX_TIMESTAMP(password_last_changed),
+				COALESCE(password_lifetime, @@global.default_password_lifetime)
+			FROM mysql.user WHERE User = ? AND Host IN (?`+strings.Repeat(", ?", len(hosts)-1)+`)`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var found int
+		for rows.Next() {
+			var lastChanged, lifetimeDays int64
+			if err := rows.Scan(&lastChanged, &lifetimeDays); err != nil {
+				return err
+			}
+			found++
+
+			hostExpiration := passwordExpiration(lastChanged, lifetimeDays)
+			if !hostExpiration.IsZero() && (expiration.IsZero() || hostExpiration.Before(expiration)) {
+				expiration = hostExpiration
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if found == 0 {
+			return fmt.Errorf("user %q does not exist", username)
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return expiration, nil
+}
+
+// passwordLastChanged returns the earliest time the user's password was last
+// changed on any of the grant hosts, so that an expiry counted from it isn't
+// sooner than intended on any of them.
+func (m *MySQL) passwordLastChanged(ctx context.Context, q rowQueryer, username string) (time.Time, error) {
+	hosts := m.grantHosts()
+	args := []interface{}{username}
+	for _, host := range hosts {
+		args = append(args, host)
+	}
+
+	var lastChanged sql.NullInt64
+	err := q.QueryRowContext(ctx, `
+		SELECT UNIX_TIMESTAMP(MIN(password_last_changed))
+		FROM mysql.user WHERE User = ? AND Host IN (?`+strings.Repeat(", ?", len(hosts)-1)+`)`, args...).Scan(&lastChanged)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !lastChanged.Valid {
+		return time.Time{}, fmt.Errorf("user %q does not exist", username)
+	}
+
+	return time.Unix(lastChanged.Int64, 0), nil
+}
+
+// passwordExpiration returns when a password changed at lastChanged expires
+// given its lifetime in days, or the zero time if it never expires.
+func passwordExpiration(lastChanged, lifetimeDays int64) time.Time {
+	if lifetimeDays == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(lastChanged, 0).Add(time.Duration(lifetimeDays) * 24 * time.Hour).UTC()
+}
+
+// User describes an account found on the server.
+type User struct {
+	Username string
+	Host     string
+
+	// PasswordLastChanged is when the password was last set, which for
+	// accounts created by Vault is usually when they were created.
+	PasswordLastChanged time.Time
+
+	// PasswordExpiration is when the server expires the password, it is the
+	// zero time if the password never expires.
+	PasswordExpiration time.Time
+
+	Locked bool
+}
+
+// ListUsers returns the accounts whose username starts with the prefix, or
+// with the configured username_prefix if it is empty, so they can be compared
+// against the active leases.
+func (m *MySQL) ListUsers(ctx context.Context, prefix string) ([]User, error) {
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	if prefix == "" {
+		if scp, ok := m.CredentialsProducer.(*credsutil.SQLCredentialsProducer); ok {
+			prefix = scp.UsernamePrefix
+		}
+	}
+	// Refuse to list every account, including the ones not created by Vault.
+	if prefix == "" {
+		return nil, fmt.Errorf("a username prefix is required to list users")
+	}
+
+	// Get the connection, the listing can tolerate some replication lag
+	db, err := m.getReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT User, Host, UNIX_TIMESTAMP(password_last_changed),
+			COALESCE(password_lifetime, @@global.default_password_lifetime),
+			account_locked
+		FROM mysql.user WHERE User LIKE ? ORDER BY User, Host`, likeEscaper.Replace(prefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		var lastChanged, lifetimeDays int64
+		var locked string
+		if err := rows.Scan(&user.Username, &user.Host, &lastChanged, &lifetimeDays, &locked); err != nil {
+			return nil, err
+		}
+
+		user.PasswordLastChanged = time.Unix(lastChanged, 0).UTC()
+		user.PasswordExpiration = passwordExpiration(lastChanged, lifetimeDays)
+		user.Locked = locked == "Y"
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// ValidateCreationStatements prepares each of the creation statements against
+// the database without executing them, so that errors in a role's statements,
+// or statements not permitted by allowed_statements, can be caught when the
+// role is written. Statements that are not supported by the prepared statement
+// protocol are skipped.
+func (m *MySQL) ValidateCreationStatements(ctx context.Context, statements dbplugin.Statements) error {
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	statements = m.withDefaultCreationStatements(statements)
+	if statements.CreationStatements == "" {
+		return dbutil.ErrEmptyCreationStatement
+	}
+
+	queries := strutil.ParseArbitraryStringSlice(statements.CreationStatements, ";")
+	if err := m.checkAllowedStatements(queries); err != nil {
+		return err
+	}
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	expirationStr, err := m.GenerateExpiration(time.Now())
+	if err != nil {
+		return err
+	}
+
+	data, err := m.withPasswordHash(statements.CreationStatements, map[string]string{
+		"name":       validationUsername,
+		"host":       m.Host,
+		"password":   validationPassword,
+		"expiration": expirationStr,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, query := range queries {
+		// Statements marked not to be prepared can not be validated
+		query, noPrepare := stripNoPrepare(query)
+		if len(query) == 0 || noPrepare {
+			continue
+		}
+		query = renderStatement(query, data)
+
+		stmt, err := conn.PrepareContext(ctx, query)
+		if err != nil {
+			// Error 1295: This command is not supported in the prepared
+			// statement protocol yet, so it can not be validated.
+			if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1295 {
+				continue
+			}
+
+			return fmt.Errorf("invalid creation statement %q: %s", query, err)
+		}
+		stmt.Close()
+	}
+
+	return nil
+}
+
+// RenewUser runs the role's renew statements, if any are set. When no renew
+// statements are provided the user's password expiry is moved to the new
+// expiration if renew_password_expiration is set, and otherwise this is a
+// NOOP.
+func (m *MySQL) RenewUser(ctx context.Context, statements dbplugin.Statements, username string, expiration time.Time) (err error) {
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	renewStatements := statements.RenewStatements
+	if renewStatements == "" && m.RenewPasswordExpiration {
+		renewStatements = defaultMysqlRenewExpirationStmts
+	}
+	if renewStatements == "" {
+		return nil
+	}
+
+	defer func(now time.Time) {
+		emitMetrics("RenewUser", now, err)
+		err = wrapConfigError(classifyError(err))
+	}(time.Now())
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	expirationStr, err := m.GenerateExpiration(expiration)
+	if err != nil {
+		return err
+	}
+
+	// PASSWORD EXPIRE INTERVAL is counted from when the password was last
+	// changed rather than from now, so the days are counted from then too.
+	scp, ok := m.CredentialsProducer.(*credsutil.SQLCredentialsProducer)
+	if ok && scp.ExpirationFormat == credsutil.ExpirationFormatDays && strings.Contains(renewStatements, "{{expiration") {
+		var lastChanged time.Time
+		err = m.withConn(ctx, db, func(conn *sql.Conn) error {
+			lastChanged, err = m.passwordLastChanged(ctx, conn, username)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		expirationStr, err = scp.GenerateExpirationSince(expiration, lastChanged)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.executeTransaction(ctx, db, m.expandHosts(strutil.ParseArbitraryStringSlice(renewStatements, ";")), map[string]string{
+		"name":       username,
+		"host":       m.Host,
+		"expiration": expirationStr,
+	})
+}
+
+func (m *MySQL) RevokeUser(ctx context.Context, statements dbplugin.Statements, username string) (err error) {
+	defer func(now time.Time) {
+		emitMetrics("RevokeUser", now, err)
+		err = wrapConfigError(classifyError(err))
+	}(time.Now())
+
+	// Grab the read lock
+	m.Lock()
+	defer m.Unlock()
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := m.revokeUser(ctx, db, m.revocationStatements(statements), username); err != nil {
+		return err
+	}
+
+	m.audit(auditOperationRevoke, "", username)
+
+	if m.FlushPrivilegesOnRevoke {
+		if err := m.flushPrivileges(ctx, db); err != nil {
+			return fmt.Errorf("user was revoked but privileges could not be flushed: %s", err)
+		}
+	}
+
+	// Revoking the user doesn't end the sessions it already has open
+	if m.KillSessionsOnRevoke {
+		err := m.withConn(ctx, db, func(conn *sql.Conn) error {
+			return killSessions(ctx, conn, username)
+		})
+		if err != nil {
+			return fmt.Errorf("user was revoked but its sessions could not be killed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// RevokeUsers revokes a batch of users, such as when many leases expire at
+// once, reusing the connection and only flushing privileges once. Each user is
+// revoked in its own transaction so that a failure doesn't affect the others;
+// the users that could not be revoked are returned with their errors.
+func (m *MySQL) RevokeUsers(ctx context.Context, statements dbplugin.Statements, usernames []string) (failed map[string]error, err error) {
+	defer func(now time.Time) {
+		emitMetrics("RevokeUsers", now, err)
+		err = wrapConfigError(classifyError(err))
+	}(time.Now())
+
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revocationStmts := m.revocationStatements(statements)
+
+	failed = make(map[string]error)
+	var revoked []string
+	for _, username := range usernames {
+		if err := m.revokeUser(ctx, db, revocationStmts, username); err != nil {
+			failed[username] = wrapConfigError(classifyError(err))
+			continue
+		}
+		revoked = append(revoked, username)
+	}
+
+	m.audit(auditOperationRevoke, "", revoked...)
+
+	if len(revoked) > 0 && m.FlushPrivilegesOnRevoke {
+		if err := m.flushPrivileges(ctx, db); err != nil {
+			return failed, fmt.Errorf("users were revoked but privileges could not be flushed: %s", err)
+		}
+	}
+
+	// Revoking the users doesn't end the sessions they already have open
+	if m.KillSessionsOnRevoke && len(revoked) > 0 {
+		err := m.withConn(ctx, db, func(conn *sql.Conn) error {
+			for _, username := range revoked {
+				if err := killSessions(ctx, conn, username); err != nil {
+					failed[username] = fmt.Errorf("user was revoked but its sessions could not be killed: %s", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			for _, username := range revoked {
+				failed[username] = fmt.Errorf("user was revoked but its sessions could not be killed: %s", err)
+			}
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil, nil
+	}
+
+	return failed, nil
+}
+
+// RollbackUser makes a best effort to remove an account that CreateUser only
+// partially set up, for example when use_transaction is disabled and a later
+// creation statement failed. The role's rollback statements are used, or
+// its revocation statements, or statements that drop the user regardless of
+// the revocation_mode. Any that fail because the user or its grants don't
+// exist are skipped.
+func (m *MySQL) RollbackUser(ctx context.Context, statements dbplugin.Statements, username string) (err error) {
+	defer func(now time.Time) {
+		emitMetrics("RollbackUser", now, err)
+		err = wrapConfigError(classifyError(err))
+	}(time.Now())
+
+	// Grab the lock
+	m.Lock()
+	defer m.Unlock()
+
+	// Get the connection
+	db, err := m.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	revocationStmts := rollbackStatements(statements)
+
+	err = m.retryTransaction(ctx, func() error {
+		return m.executeRevocation(ctx, db, revocationStmts, username, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	if m.DropDatabaseOnRevoke {
+		if err := m.dropDatabase(ctx, db, username); err != nil {
+			return fmt.Errorf("user was rolled back but its database could not be dropped: %s", err)
+		}
+	}
+
+	m.audit(auditOperationRollback, "", username)
+
+	if m.FlushPrivilegesOnRevoke {
+		if err := m.flushPrivileges(ctx, db); err != nil {
+			return fmt.Errorf("user was rolled back but privileges could not be flushed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// rollbackStatements returns the role's rollback statements, or its
+// revocation statements, or statements that drop the user regardless of the
+// revocation_mode.
+func rollbackStatements(statements dbplugin.Statements) string {
+	if statements.RollbackStatements != "" {
+		return statements.RollbackStatements
+	}
+	if statements.RevocationStatements != "" {
+		return statements.RevocationStatements
+	}
+
+	return defaultMysqlRevocationStmts
+}
+
+// rollbackCreatedUser removes a user that was created but failed
+// verification. Besides the grant hosts, the user is dropped from any other
+// host the creation statements created it at, which the rollback statements
+// wouldn't reach.
+func (m *MySQL) rollbackCreatedUser(ctx context.Context, db *sql.DB, statements dbplugin.Statements, queries []string, data map[string]string, username string) error {
+	revocationStmts := rollbackStatements(statements)
+	for _, host := range m.statementHosts(queries, data, username) {
+		revocationStmts += ";DROP USER '{{name}}'@'" + host + "'"
+	}
+
+	err := m.retryTransaction(ctx, func() error {
+		return m.executeRevocation(ctx, db, revocationStmts, username, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.audit(auditOperationRollback, "", username)
+
+	return nil
+}
+
+// statementHosts returns the hosts, other than the grant hosts, that the
+// statements name the user at, in their escaped form.
+func (m *MySQL) statementHosts(queries []string, data map[string]string, username string) []string {
+	grantHosts := make(map[string]bool)
+	for _, host := range m.grantHosts() {
+		grantHosts[valueEscaper.Replace(host)] = true
+	}
+
+	var hosts []string
+	for _, query := range queries {
+		for _, match := range accountRe.FindAllStringSubmatch(renderStatement(query, data), -1) {
+			if match[1] != valueEscaper.Replace(username) || grantHosts[match[2]] {
+				continue
+			}
+			grantHosts[match[2]] = true
+			hosts = append(hosts, match[2])
+		}
+	}
+
+	return hosts
+}
+
+// revocationStatements returns the role's revocation statements, or the
+// default statements for the configured revocation mode if it has none.
+func (m *MySQL) revocationStatements(statements dbplugin.Statements) string {
+	if statements.RevocationStatements != "" {
+		return statements.RevocationStatements
+	}
+
+	switch m.RevocationMode {
+	case revocationModeDisable:
+		return defaultMysqlDisableStmts
+	default:
+		return defaultMysqlRevocationStmts
+	}
+}
+
+// revokeUser runs the revocation statements for a single user.
+func (m *MySQL) revokeUser(ctx context.Context, db *sql.DB, revocationStmts, username string) error {
+	// Objects defined by the user stop working once it is dropped
+	if m.RevokeOwnedObjects != "" {
+		if err := m.revokeOwnedObjects(ctx, db, username); err != nil {
+			return fmt.Errorf("error revoking objects owned by user: %s", err)
+		}
+	}
+
+	// Dropping the user can wait on metadata locks held by long running
+	// transactions, so retry it like the other transactions.
+	err := m.retryTransaction(ctx, func() error {
+		return m.executeRevocation(ctx, db, revocationStmts, username, false)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Catch revocation statements that leave the account usable
+	if m.VerifyRevocation {
+		err := m.withConn(ctx, db, func(conn *sql.Conn) error {
+			return m.verifyUserRevoked(ctx, conn, username)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.DropDatabaseOnRevoke {
+		if err := m.dropDatabase(ctx, db, username); err != nil {
+			return fmt.Errorf("user was revoked but its database could not be dropped: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// executeRevocation runs the revocation statements for the user within a
+// single transaction. If ignoreMissing is set, statements that fail because
+// the user or its grants don't exist are skipped.
+func (m *MySQL) executeRevocation(ctx context.Context, db *sql.DB, revocationStmts, username string, ignoreMissing bool) error {
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reset, err := m.setStatementTimeout(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer reset()
+
+	// Start a transaction
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range m.expandHosts(strutil.ParseArbitraryStringSlice(revocationStmts, ";")) {
+		query = strings.TrimSpace(query)
+		if len(query) == 0 {
+			continue
+		}
+
+		// This is not a prepared statement because not all commands are supported
+		// 1295: This command is not supported in the prepared statement protocol yet
+		// Reference https://mariadb.com/kb/en/mariadb/prepare-statement/
+		m.logger.Debug("mysql: executing revocation statement", "statement", query)
+		query = renderStatement(query, map[string]string{
+			"name": username,
+			"host": m.Host,
+		})
+		_, err = tx.ExecContext(ctx, query)
+		if err != nil && ignoreMissing && isMissingUserError(err) {
+			m.logger.Debug("mysql: user or grant does not exist, skipping statement")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// isMissingUserError returns true if the statement failed because the user,
+// or the grant it tried to revoke, doesn't exist.
+func isMissingUserError(err error) bool {
+	e, ok := err.(*stdmysql.MySQLError)
+	if !ok {
+		return false
+	}
+
+	switch e.Number {
+	case 1141, 1147, 1269, 1396, 1403:
+		// 1141: There is no such grant defined for user
+		// 1147: There is no such grant defined for user on table
+		// 1269: Can't revoke all privileges for one or more of the requested users
+		// 1396: Operation DROP USER failed
+		// 1403: There is no such grant defined for user on routine
+		return true
+	}
+
+	return false
+}
+
+// executeWithoutTransaction runs the queries one after the other on a single
+// connection, so that statements which can't be run in a transaction, or
+// which implicitly commit it, behave as they would outside of Vault.
+func (m *MySQL) executeWithoutTransaction(ctx context.Context, db *sql.DB, queries []string, data map[string]string) error {
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reset, err := m.setStatementTimeout(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer reset()
+
+	return m.executeStatements(ctx, conn, queries, data)
+}
+
+// acquireConn takes a connection from the pool, giving up after the
+// acquire_timeout if none become available. Only taking the connection is
+// limited, not the statements then run on it.
+func (m *MySQL) acquireConn(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	if m.acquireTimeout <= 0 {
+		return db.Conn(ctx)
+	}
+
+	acquireCtx, cancel := context.WithTimeout(ctx, m.acquireTimeout)
+	defer cancel()
+
+	conn, err := db.Conn(acquireCtx)
+	if err != nil && ctx.Err() == nil && acquireCtx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("no available connection within the acquire_timeout of %s", m.acquireTimeout)
+	}
+
+	return conn, err
+}
+
+// flushPrivileges reloads the grant tables.
+func (m *MySQL) flushPrivileges(ctx context.Context, db *sql.DB) error {
+	return m.withConn(ctx, db, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "FLUSH PRIVILEGES")
+		return err
+	})
+}
+
+// withConn runs f on a connection taken from the pool with acquireConn, so
+// that single queries are limited by the acquire_timeout like transactions.
+func (m *MySQL) withConn(ctx context.Context, db *sql.DB, f func(conn *sql.Conn) error) error {
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return f(conn)
+}
+
+// killSessions terminates the connections the user still has open. Sessions
+// that end before they can be killed are ignored.
+func killSessions(ctx context.Context, conn *sql.Conn, username string) error {
+	rows, err := conn.QueryContext(ctx, "SELECT ID FROM information_schema.PROCESSLIST WHERE USER = ?", username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf("KILL %d", id))
+		// Error 1094: Unknown thread id, the session has already ended
+		if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1094 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// emitMetrics records how long the operation took, including committing its
+// transaction, and if it failed whether it failed to reach the server or to
+// execute a statement.
+func emitMetrics(op string, start time.Time, err error) {
+	metrics.MeasureSince([]string{"database", mySQLTypeName, op, "duration"}, start)
+
+	if err == nil {
+		return
+	}
+
+	switch {
+	case isConnectionError(err):
+		metrics.IncrCounter([]string{"database", mySQLTypeName, op, "error", "connection"}, 1)
+	case isStatementError(err):
+		metrics.IncrCounter([]string{"database", mySQLTypeName, op, "error", "statement"}, 1)
+	}
+}
+
+// emitPoolMetrics records the utilization of the connection pool each time
+// it is used, so that max_open_connections can be sized to the load.
+func emitPoolMetrics(pool string, db *sql.DB) {
+	stats := db.Stats()
+
+	metrics.SetGauge([]string{"database", mySQLTypeName, pool, "open"}, float32(stats.OpenConnections))
+	metrics.SetGauge([]string{"database", mySQLTypeName, pool, "in_use"}, float32(stats.InUse))
+	metrics.SetGauge([]string{"database", mySQLTypeName, pool, "idle"}, float32(stats.Idle))
+	metrics.SetGauge([]string{"database", mySQLTypeName, pool, "wait_count"}, float32(stats.WaitCount))
+	metrics.SetGauge([]string{"database", mySQLTypeName, pool, "wait_duration"}, float32(stats.WaitDuration/time.Millisecond))
+}
+
+// wrapConfigError wraps errors caused by the configured credentials being
+// rejected by the server in a dbutil.ConfigError, so that they can be told
+// apart from transient failures.
+func wrapConfigError(err error) error {
+	e, ok := err.(*stdmysql.MySQLError)
+	if !ok {
+		return err
+	}
+
+	switch e.Number {
+	case 1044, 1045:
+		// 1044: Access denied for user to database
+		// 1045: Access denied for user (using password)
+		return &dbutil.ConfigError{Err: err}
+	case 1820, 1862:
+		// 1820: You must reset your password before executing this statement
+		// 1862: Your password has expired
+		return &dbutil.ConfigError{Err: fmt.Errorf("the password of the user Vault connects as has expired and must be reset on the server: %s", err)}
+	}
+
+	return err
+}
+
+// NetworkError is returned when the server can't be reached.
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("error connecting to database: %s", e.Err)
+}
+
+// AuthError is returned when the server rejects the configured credentials.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("error authenticating to database: %s", e.Err)
+}
+
+// PermissionError is returned when the configured user lacks the privileges
+// needed to use the database.
+type PermissionError struct {
+	Err error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("insufficient database privileges: %s", e.Err)
+}
+
+// StatementError is returned when the server fails to execute a statement for
+// a reason other than the configured user's credentials or privileges, such as
+// an error in the role's statements.
+type StatementError struct {
+	Err error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("error executing statement: %s", e.Err)
+}
+
+// CapacityError is returned by CreateUser when check_capacity is set and the
+// server has no connections left for the new user, so that callers can back
+// off and retry later.
+type CapacityError struct {
+	Connected      int
+	MaxConnections int
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("database server is at capacity with %d of %d connections in use", e.Connected, e.MaxConnections)
+}
+
+// checkCapacity returns a *CapacityError if the server has reached its
+// max_connections.
+func checkCapacity(ctx context.Context, q rowQueryer) error {
+	var maxConnections int
+	if err := q.QueryRowContext(ctx, "SELECT @@GLOBAL.max_connections").Scan(&maxConnections); err != nil {
+		return err
+	}
+
+	var name string
+	var connected int
+	if err := q.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Threads_connected'").Scan(&name, &connected); err != nil {
+		return err
+	}
+
+	if connected >= maxConnections {
+		return &CapacityError{Connected: connected, MaxConnections: maxConnections}
+	}
+
+	return nil
+}
+
+// classifyConnectionError wraps an error from establishing a connection in
+// the error type matching its cause.
+func classifyConnectionError(err error) error {
+	if e, ok := err.(*stdmysql.MySQLError); ok {
+		switch e.Number {
+		case 1045, 1820, 1862:
+			// 1045: Access denied for user (using password)
+			// 1820: You must reset your password before executing this statement
+			// 1862: Your password has expired
+			return &AuthError{Err: err}
+		case 1044, 1142, 1227:
+			// 1044: Access denied for user to database
+			// 1142: Command denied to user for table
+			// 1227: Access denied; you need the privilege for this operation
+			return &PermissionError{Err: err}
+		}
+	}
+
+	if err != connutil.ErrNotInitialized && isConnectionError(err) {
+		return &NetworkError{Err: err}
+	}
+
+	return err
+}
+
+// classifyError wraps an error returned by an operation in the error type
+// matching its cause, so that callers can tell whether to retry, update the
+// configuration or fix the statements without parsing the message. Errors
+// caused by the configured credentials are left for wrapConfigError.
+func classifyError(err error) error {
+	if e, ok := err.(*stdmysql.MySQLError); ok {
+		switch e.Number {
+		case 1044, 1045, 1820, 1862:
+			return err
+		case 1142, 1227:
+			// 1142: Command denied to user for table
+			// 1227: Access denied; you need the privilege for this operation
+			return &PermissionError{Err: err}
+		}
+
+		return &StatementError{Err: err}
+	}
+
+	if err != connutil.ErrNotInitialized && isConnectionError(err) {
+		return &NetworkError{Err: err}
+	}
+
+	return err
+}
+
+// isReconnectableError returns true if the error is from a connection to a
+// server which is unavailable, but may come back shortly.
+func isReconnectableError(err error) bool {
+	// 1040: Too many connections
+	if e, ok := err.(*stdmysql.MySQLError); ok {
+		return e.Number == 1040
+	}
+
+	// The driver reports 2006 (server has gone away) and 2013 (lost
+	// connection) as invalid or bad connections.
+	return err != connutil.ErrNotInitialized && isConnectionError(err)
+}
+
+// isConnectionError returns true if the error was caused by failing to
+// establish or use a connection to the server.
+func isConnectionError(err error) bool {
+	switch err {
+	case driver.ErrBadConn, stdmysql.ErrInvalidConn, connutil.ErrNotInitialized:
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// isStatementError returns true if the error was returned by the server while
+// executing a statement.
+func isStatementError(err error) bool {
+	_, ok := err.(*stdmysql.MySQLError)
+	return ok
+}
+
+// retryTransaction runs fn, retrying it with a jittered backoff up to the
+// configured number of times if it fails on a deadlock or lock wait timeout.
+func (m *MySQL) retryTransaction(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= m.MaxTransactionRetries || !isRetryableError(err) {
+			return err
+		}
+
+		backoff := time.Duration(attempt+1) * retryBackoff
+		backoff += time.Duration(rand.Int63n(int64(retryBackoff)))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// isRetryableError returns true if the error is a transient MySQL error after
+// which the transaction can safely be retried.
+func isRetryableError(err error) bool {
+	e, ok := err.(*stdmysql.MySQLError)
+	if !ok {
+		return false
+	}
+
+	switch e.Number {
+	case 1205, 1213:
+		// 1205: Lock wait timeout exceeded; try restarting transaction
+		// 1213: Deadlock found when trying to get lock; try restarting transaction
+		return true
+	}
+
+	return false
+}
+
+// executeTransaction runs the queries within a single transaction, which is
+// rolled back if any of them fail.
+func (m *MySQL) executeTransaction(ctx context.Context, db *sql.DB, queries []string, data map[string]string) error {
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reset, err := m.setStatementTimeout(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer reset()
+
+	// Start a transaction
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Execute each query
+	if err := m.executeStatements(ctx, tx, queries, data); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// setStatementTimeout limits the server side execution time of statements run
+// on the connection's session to the configured query_timeout, or to the time
+// left until the context's deadline if that is sooner. MariaDB applies the
+// limit to every statement, while MySQL only applies it to read only SELECT
+// statements, so it does not limit CREATE USER, GRANT or DROP USER there. The
+// returned function restores the session's previous limit, so that it doesn't
+// remain on the pooled connection, and must be called once the statements
+// have run. This is a NOOP unless a query_timeout is configured.
+func (m *MySQL) setStatementTimeout(ctx context.Context, conn *sql.Conn) (func(), error) {
+	noop := func() {}
+	if m.queryTimeout <= 0 {
+		return noop, nil
+	}
+
+	timeout := m.queryTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	// A value of zero disables the limit, so always allow at least a
+	// millisecond.
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+
+	version, err := m.serverVersion(ctx, conn)
+	if err != nil {
+		return noop, err
+	}
+
+	variable, value := "max_execution_time", fmt.Sprintf("%d", timeout/time.Millisecond)
+	if flavor(version) == flavorMariaDB {
+		variable, value = "max_statement_time", fmt.Sprintf("%f", timeout.Seconds())
+	}
+
+	var previous string
+	err = conn.QueryRowContext(ctx, "SELECT @@SESSION."+variable).Scan(&previous)
+	// Error 1193: Unknown system variable, the server does not support limiting
+	// the execution time so continue without it.
+	if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1193 {
+		return noop, nil
+	}
+	if err != nil {
+		return noop, err
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET SESSION %s = %s", variable, value)); err != nil {
+		return noop, err
+	}
+
+	return func() {
+		// The operation's context may have expired by now
+		resetCtx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+		defer cancel()
+
+		if _, err := conn.ExecContext(resetCtx, fmt.Sprintf("SET SESSION %s = %s", variable, previous)); err != nil {
+			m.logger.Debug("mysql: error resetting the query_timeout, discarding the connection", "error", err)
+			discardConn(conn)
+		}
+	}, nil
+}
+
+// discardConn closes the connection instead of returning it to the pool, for
+// connections left in an unknown state.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
+
+// rowQueryer is implemented by both *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// execer is implemented by both *sql.Tx and *sql.Conn, so that statements can
+// be run with or without a transaction.
+type execer interface {
+	rowQueryer
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// serverVersion returns the version string reported by the server, caching it
+// after the first lookup.
+func (m *MySQL) serverVersion(ctx context.Context, q rowQueryer) (string, error) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	if m.version != "" {
+		return m.version, nil
+	}
+
+	if err := q.QueryRowContext(ctx, "SELECT VERSION()").Scan(&m.version); err != nil {
+		return "", err
+	}
+
+	return m.version, nil
+}
+
+// flavor returns the flavor of the server reporting the version.
+func flavor(version string) string {
+	if strings.Contains(strings.ToLower(version), flavorMariaDB) {
+		return flavorMariaDB
+	}
+
+	return flavorMySQL
+}
+
+// executeStatements templates and runs each of the queries within the
+// provided transaction, or on the provided connection.
+func (m *MySQL) executeStatements(ctx context.Context, tx execer, queries []string, data map[string]string) error {
+	for _, query := range queries {
+		query, noPrepare := stripNoPrepare(query)
+		if len(query) == 0 {
+			continue
+		}
+
+		tpl, err := m.withAuthPlugin(ctx, tx, query)
+		if err != nil {
+			return err
+		}
+		m.logger.Debug("mysql: executing statement", "statement", tpl)
+
+		err = m.executeStatement(ctx, tx, tpl, renderStatement(tpl, data), !noPrepare)
+		if err != nil && m.CreateIfNotExists && isUserExistsError(tpl, err) {
+			// The user was left behind by an earlier attempt, so update it to
+			// match the statement instead of failing.
+			m.logger.Debug("mysql: user already exists, altering it instead")
+			tpl = createUserRe.ReplaceAllString(tpl, "ALTER USER")
+			err = m.executeStatement(ctx, tx, tpl, renderStatement(tpl, data), !noPrepare)
+		}
+		if err != nil {
+			return redactError(err, data)
+		}
+	}
+
+	return nil
+}
+
+// stripNoPrepare returns the statement without its leading noPrepareMarker,
+// and whether it had one.
+func stripNoPrepare(query string) (string, bool) {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(query, noPrepareMarker) {
+		return query, false
+	}
+
+	rest := query[len(noPrepareMarker):]
+	if len(rest) > 0 && !unicode.IsSpace(rune(rest[0])) {
+		return query, false
+	}
+
+	return strings.TrimSpace(rest), true
+}
+
+// redactError removes the password from an error returned by the server,
+// which may echo back the statement it failed on, so that it isn't returned
+// to the client or written to the audit log. The error keeps its type and
+// number so that it is still classified and retried the same.
+func redactError(err error, data map[string]string) error {
+	e, ok := err.(*stdmysql.MySQLError)
+	if !ok {
+		return err
+	}
+
+	message := errorPasswordRe.ReplaceAllString(e.Message, "${1}'"+redactedPassword+"'")
+	for _, key := range []string{"password", "password_hash"} {
+		if data[key] != "" {
+			message = strings.Replace(message, valueEscaper.Replace(data[key]), redactedPassword, -1)
+		}
+	}
+
+	if message == e.Message {
+		return err
+	}
+
+	return &stdmysql.MySQLError{Number: e.Number, Message: message}
+}
+
+// withPasswordHash replaces the password in the template data with its
+// mysql_native_password hash when password_hashing is "client". The
+// statements must then only use {{password_hash}}, so that the plaintext
+// password never reaches the server.
+func (m *MySQL) withPasswordHash(statements string, data map[string]string) (map[string]string, error) {
+	if m.PasswordHashing != passwordHashingClient {
+		return data, nil
+	}
+
+	if passwordPlaceholderRe.MatchString(statements) {
+		return nil, fmt.Errorf("statements must use {{password_hash}} instead of {{password}} when password_hashing is %q", passwordHashingClient)
+	}
+
+	data["password_hash"] = nativePasswordHash(data["password"])
+	delete(data, "password")
+
+	return data, nil
+}
+
+// nativePasswordHash returns the mysql_native_password hash of the password,
+// as used with IDENTIFIED BY PASSWORD or IDENTIFIED WITH
+// mysql_native_password AS.
+func nativePasswordHash(password string) string {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+
+	return "*" + strings.ToUpper(hex.EncodeToString(stage2[:]))
+}
+
+// renderStatement templates the statement with the values escaped for use
+// within string literals, so that names or passwords containing quotes
+// can't break out of them, or quoted by the template functions.
+func renderStatement(tpl string, data map[string]string) string {
+	return dbutil.QueryHelperFuncs(tpl, data, valueEscaper.Replace, templateFuncs)
+}
+
+// grantsRoles returns true if any of the queries grant roles, rather than
+// privileges, and none of them set the user's default roles.
+func grantsRoles(queries []string) bool {
+	var roleGrant bool
+	for _, query := range queries {
+		query, _ = stripNoPrepare(query)
+		if defaultRoleRe.MatchString(query) {
+			return false
+		}
+
+		// Role grants are the GRANT statements without an ON clause
+		if grantRe.MatchString(query) {
+			if loc := grantToRe.FindStringIndex(query); loc != nil && !grantOnRe.MatchString(query[:loc[0]]) {
+				roleGrant = true
+			}
+		}
+	}
+
+	return roleGrant
+}
+
+// requireClause returns the REQUIRE clause for the configured TLS
+// requirements, or an empty string if there are none. The certificate subject,
+// issuer and cipher requirements are combined, and take precedence over
+// require_x509 and require_ssl which they imply.
+func (m *MySQL) requireClause() string {
+	var requirements []string
+	for _, requirement := range []struct {
+		option string
+		value  string
+	}{
+		{"SUBJECT", m.RequireSubject},
+		{"ISSUER", m.RequireIssuer},
+		{"CIPHER", m.RequireCipher},
+	} {
+		if requirement.value != "" {
+			requirements = append(requirements, fmt.Sprintf("%s '%s'", requirement.option, valueEscaper.Replace(requirement.value)))
+		}
+	}
+
+	if len(requirements) > 0 {
+		return "REQUIRE " + strings.Join(requirements, " AND ")
+	}
+
+	switch {
+	case m.RequireX509:
+		return "REQUIRE X509"
+	case m.RequireSSL:
+		return "REQUIRE SSL"
+	}
+
+	return ""
+}
+
+// accountMetadataStmts returns the statements tagging the user with the
+// configured comment and attributes, rendered from the metadata, and adds the
+// rendered values to the template data. Servers that don't support account
+// metadata are left without it.
+func (m *MySQL) accountMetadataStmts(ctx context.Context, q rowQueryer, data, metadata map[string]string) ([]string, error) {
+	if m.UserComment == "" && len(m.UserAttributes) == 0 {
+		return nil, nil
+	}
+
+	version, err := m.serverVersion(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if !supportsAccountMetadata(version) {
+		m.logger.Debug("mysql: server does not support account comments or attributes, skipping them", "version", version)
+		return nil, nil
+	}
+
+	var stmts []string
+	if m.UserComment != "" {
+		data["comment"] = dbutil.QueryHelper(m.UserComment, metadata)
+		stmts = append(stmts, alterUserStmt+" COMMENT '{{comment}}'")
+	}
+
+	if len(m.UserAttributes) > 0 {
+		attributes := make(map[string]string, len(m.UserAttributes))
+		for name, value := range m.UserAttributes {
+			attributes[name] = dbutil.QueryHelper(value, metadata)
+		}
+
+		b, err := json.Marshal(attributes)
+		if err != nil {
+			return nil, err
+		}
+		data["attributes"] = string(b)
+		stmts = append(stmts, alterUserStmt+" ATTRIBUTE '{{attributes}}'")
+	}
+
+	return stmts, nil
+}
+
+// checkResourceGroup returns an error if the resource_group can't be used on
+// the server, as it doesn't support resource groups or the group doesn't
+// exist or is a SYSTEM group, which user sessions can't be assigned to.
+func (m *MySQL) checkResourceGroup(ctx context.Context, q rowQueryer) error {
+	if m.ResourceGroup == "" {
+		return nil
+	}
+
+	version, err := m.serverVersion(ctx, q)
+	if err != nil {
+		return err
+	}
+	if !supportsResourceGroups(version) {
+		return fmt.Errorf("resource_group requires MySQL %s or later, the server is %s", resourceGroupVersion, version)
+	}
+
+	var groupType string
+	err = q.QueryRowContext(ctx, "SELECT RESOURCE_GROUP_TYPE FROM INFORMATION_SCHEMA.RESOURCE_GROUPS WHERE RESOURCE_GROUP_NAME = ?", m.ResourceGroup).Scan(&groupType)
+	switch {
+	case err == sql.ErrNoRows:
+		return fmt.Errorf("resource_group %q does not exist", m.ResourceGroup)
+	case err != nil:
+		return err
+	case groupType != "USER":
+		return fmt.Errorf("resource_group %q is a %s resource group, it must be a USER resource group", m.ResourceGroup, groupType)
+	}
+
+	return nil
+}
+
+// supportsAccountMetadata returns true if the server reporting the version
+// supports the COMMENT and ATTRIBUTE account options.
+func supportsAccountMetadata(version string) bool {
+	return mysqlVersionAtLeast(version, accountMetadataVersion)
+}
+
+// supportsResourceGroups returns true if the server reporting the version
+// supports resource groups.
+func supportsResourceGroups(version string) bool {
+	return mysqlVersionAtLeast(version, resourceGroupVersion)
+}
+
+// mysqlVersionAtLeast returns true if the server reporting the version is
+// MySQL, rather than MariaDB, of at least the minimum version.
+func mysqlVersionAtLeast(version string, min *goversion.Version) bool {
+	if flavor(version) == flavorMariaDB {
+		return false
+	}
+
+	// Strip suffixes such as -log, which would otherwise be compared as a
+	// pre-release
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+
+	v, err := goversion.NewVersion(version)
+	if err != nil {
+		return false
+	}
+
+	return !v.LessThan(min)
+}
+
+// setsRequire returns true if any of the queries set the user's TLS
+// requirements.
+func setsRequire(queries []string) bool {
+	for _, query := range queries {
+		if query, _ = stripNoPrepare(query); requireRe.MatchString(query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withAuthPlugin rewrites a CREATE USER statement that doesn't specify an
+// authentication plugin to use the configured auth_plugin. MariaDB uses its
+// own syntax for this, which is needed for plugins such as ed25519. Statements
+// using the MariaDB syntax, or plugins only MariaDB provides, are rejected
+// when connected to MySQL.
+func (m *MySQL) withAuthPlugin(ctx context.Context, q rowQueryer, query string) (string, error) {
+	usesVia := identifiedViaRe.MatchString(query)
+	rewrite := m.AuthPlugin != "" && createUserRe.MatchString(query) && !identifiedWithRe.MatchString(query) && !usesVia
+	if !rewrite && !usesVia {
+		return query, nil
+	}
+
+	version, err := m.serverVersion(ctx, q)
+	if err != nil {
+		return "", err
+	}
+
+	if flavor(version) == flavorMariaDB {
+		if !rewrite {
+			return query, nil
+		}
+		return passwordRe.ReplaceAllString(query, "IDENTIFIED VIA "+m.AuthPlugin+" USING PASSWORD($1)"), nil
+	}
+
+	if usesVia {
+		return "", fmt.Errorf("IDENTIFIED VIA is only supported by MariaDB, use IDENTIFIED WITH on MySQL %s", version)
+	}
+	if mariaDBAuthPlugins[m.AuthPlugin] {
+		return "", fmt.Errorf("auth_plugin %q is only supported by MariaDB, not MySQL %s", m.AuthPlugin, version)
+	}
+
+	return identifiedByRe.ReplaceAllString(query, "IDENTIFIED WITH "+m.AuthPlugin+" BY"), nil
+}
+
+// executeStatement runs a single statement, rendered from the template,
+// within the provided transaction, or on the provided connection, giving up on
+// it after the statement_timeout.
+func (m *MySQL) executeStatement(ctx context.Context, tx execer, tpl, query string, prepare bool) error {
+	if m.statementTimeout <= 0 {
+		return m.prepareAndExecute(ctx, tx, tpl, query, prepare)
+	}
+
+	stmtCtx, cancel := context.WithTimeout(ctx, m.statementTimeout)
+	defer cancel()
+
+	err := m.prepareAndExecute(stmtCtx, tx, tpl, query, prepare)
+	if err != nil && ctx.Err() == nil && stmtCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("statement did not complete within the statement_timeout of %s", m.statementTimeout)
+	}
+
+	return err
+}
+
+// prepareAndExecute runs the statement as a prepared statement where the
+// server supports it, unless prepare is false. The prepared statement is
+// closed before returning, rather than when the transaction ends, so that
+// roles with many statements don't run into the server's
+// max_prepared_stmt_count.
+func (m *MySQL) prepareAndExecute(ctx context.Context, tx execer, tpl, query string, prepare bool) error {
+	// Don't try to prepare statements the server has refused to before, or
+	// which are marked not to be. Proxy grants can't be prepared either, but
+	// not every server version rejects them with 1295.
+	m.stateLock.Lock()
+	unpreparable := !prepare || m.unpreparable[tpl] || grantProxyRe.MatchString(tpl)
+	m.stateLock.Unlock()
+	if unpreparable {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		// If the error code we get back is Error 1295: This command is not
+		// supported in the prepared statement protocol yet, we will execute
+		// the statement without preparing it. This allows the caller to
+		// manually prepare statements, as well as run other not yet
+		// prepare supported commands.
+		if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1295 {
+			m.logger.Debug("mysql: statement can't be prepared, executing it directly")
+			m.stateLock.Lock()
+			if m.unpreparable == nil {
+				m.unpreparable = make(map[string]bool)
+			}
+			m.unpreparable[tpl] = true
+			m.stateLock.Unlock()
+			_, err = tx.ExecContext(ctx, query)
+		}
+
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// isUserExistsError returns true if the error was caused by a CREATE USER
+// statement for a user that already exists.
+func isUserExistsError(query string, err error) bool {
+	// Error 1396: Operation CREATE USER failed
+	e, ok := err.(*stdmysql.MySQLError)
+	return ok && e.Number == 1396 && createUserRe.MatchString(query)
 }
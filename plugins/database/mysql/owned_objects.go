@@ -0,0 +1,222 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// routineHeaderRe matches the definer, kind and name at the start of the
+	// definition returned by SHOW CREATE PROCEDURE or FUNCTION.
+	routineHeaderRe = regexp.MustCompile("(?is)^CREATE\\s+DEFINER\\s*=\\s*(\\S+)\\s+(PROCEDURE|FUNCTION)\\s+(`(?:[^`]|``)*`|\\w+)")
+)
+
+// ownedObject is a stored routine or view the user is the definer of.
+type ownedObject struct {
+	schema string
+	name   string
+
+	// kind is PROCEDURE, FUNCTION or VIEW.
+	kind string
+
+	// The view's definition, used to reassign it.
+	definition   string
+	checkOption  string
+	securityType string
+}
+
+func (o ownedObject) identifier() string {
+	return quoteIdentifier(o.schema) + "." + quoteIdentifier(o.name)
+}
+
+// revokeOwnedObjects reassigns or drops the stored routines and views the user
+// is the definer of, based on the configured revoke_owned_objects.
+func (m *MySQL) revokeOwnedObjects(ctx context.Context, db *sql.DB, username string) error {
+	// Pin a single session, since reassigning routines changes its sql_mode.
+	conn, err := m.acquireConn(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var objects []ownedObject
+	for _, host := range m.grantHosts() {
+		hostObjects, err := ownedObjects(ctx, conn, username+"@"+host)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, hostObjects...)
+	}
+
+	for _, object := range objects {
+		switch {
+		case m.RevokeOwnedObjects == ownedObjectsDrop:
+			_, err = conn.ExecContext(ctx, fmt.Sprintf("DROP %s IF EXISTS %s", object.kind, object.identifier()))
+		case object.kind == "VIEW":
+			err = reassignView(ctx, conn, object)
+		default:
+			err = reassignRoutine(ctx, conn, object)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", strings.ToLower(object.kind), object.identifier(), err)
+		}
+	}
+
+	return nil
+}
+
+// ownedObjects returns the stored routines and views with the definer.
+func ownedObjects(ctx context.Context, conn *sql.Conn, definer string) ([]ownedObject, error) {
+	var objects []ownedObject
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT ROUTINE_SCHEMA, ROUTINE_NAME, ROUTINE_TYPE
+		FROM information_schema.ROUTINES WHERE DEFINER = ?`, definer)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var object ownedObject
+		if err := rows.Scan(&object.schema, &object.name, &object.kind); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = conn.QueryContext(ctx, `
+		SELECT TABLE_SCHEMA, TABLE_NAME, VIEW_DEFINITION, CHECK_OPTION, SECURITY_TYPE
+		FROM information_schema.VIEWS WHERE DEFINER = ?`, definer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		object := ownedObject{kind: "VIEW"}
+		if err := rows.Scan(&object.schema, &object.name, &object.definition, &object.checkOption, &object.securityType); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+
+	return objects, rows.Err()
+}
+
+// reassignView makes the user running the statement the definer of the view.
+func reassignView(ctx context.Context, conn *sql.Conn, view ownedObject) error {
+	query := fmt.Sprintf("ALTER DEFINER = CURRENT_USER SQL SECURITY %s VIEW %s AS %s", view.securityType, view.identifier(), view.definition)
+	if view.checkOption != "" && view.checkOption != "NONE" {
+		query += fmt.Sprintf(" WITH %s CHECK OPTION", view.checkOption)
+	}
+
+	_, err := conn.ExecContext(ctx, query)
+	return err
+}
+
+// reassignRoutine makes the user running the statement the definer of the
+// routine. Routines can't be altered to change their definer, so they are
+// dropped and recreated under the SQL mode they were created with. A copy is
+// created first, so that a routine that can't be recreated isn't dropped, and
+// the original is restored if recreating it still fails.
+func reassignRoutine(ctx context.Context, conn *sql.Conn, routine ownedObject) error {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SHOW CREATE %s %s", routine.kind, routine.identifier()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("routine not found")
+	}
+
+	// The name, sql_mode, definition and character set columns
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(values) < 3 || !values[2].Valid {
+		return fmt.Errorf("routine definition is not visible, the SELECT privilege on mysql.proc may be missing")
+	}
+	sqlMode, definition := values[1].String, values[2].String
+
+	header := routineHeaderRe.FindStringSubmatchIndex(definition)
+	if header == nil {
+		return fmt.Errorf("unrecognized routine definition")
+	}
+	originalDefiner := definition[header[2]:header[3]]
+
+	var originalMode string
+	if err := conn.QueryRowContext(ctx, "SELECT @@SESSION.sql_mode").Scan(&originalMode); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "SET SESSION sql_mode = ?", sqlMode); err != nil {
+		return err
+	}
+	defer func() {
+		// The operation's context may have expired by now, and the connection
+		// is returned to the pool with the routine's mode otherwise
+		resetCtx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+		defer cancel()
+
+		if _, err := conn.ExecContext(resetCtx, "SET SESSION sql_mode = ?", originalMode); err != nil {
+			discardConn(conn)
+		}
+	}()
+
+	check := routine
+	check.name = "vault_reassign_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := conn.ExecContext(ctx, routineStatement(definition, header, "CURRENT_USER", check.identifier())); err != nil {
+		return fmt.Errorf("routine can't be recreated, it was left in place: %s", err)
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("DROP %s %s", check.kind, check.identifier())); err != nil {
+		return fmt.Errorf("error dropping the copy %s: %s", check.identifier(), err)
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("DROP %s %s", routine.kind, routine.identifier())); err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, routineStatement(definition, header, "CURRENT_USER", routine.identifier()))
+	if err == nil {
+		return nil
+	}
+	if _, restoreErr := conn.ExecContext(ctx, routineStatement(definition, header, originalDefiner, routine.identifier())); restoreErr != nil {
+		return fmt.Errorf("error recreating the routine: %s; error restoring the original routine, it was dropped: %s", err, restoreErr)
+	}
+	return fmt.Errorf("error recreating the routine, the original was restored: %s", err)
+}
+
+// routineStatement rewrites the routine's definition, whose header was
+// matched by routineHeaderRe, to create it with the definer and the schema
+// qualified identifier, since SHOW CREATE doesn't include the schema.
+func routineStatement(definition string, header []int, definer, identifier string) string {
+	kind := definition[header[4]:header[5]]
+	return fmt.Sprintf("CREATE DEFINER = %s %s %s", definer, kind, identifier) + definition[header[1]:]
+}
+
+// quoteIdentifier quotes a schema or object name.
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
@@ -0,0 +1,181 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
+)
+
+func TestMySQL_RevokeUser_OwnedObjects(t *testing.T) {
+	cleanup, connURL := prepareMySQLTestContainer(t)
+	defer cleanup()
+
+	root, err := sql.Open("mysql", connURL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer root.Close()
+
+	if _, err := root.Exec("CREATE DATABASE IF NOT EXISTS vault_owned"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, mode := range []string{ownedObjectsDrop, ownedObjectsReassign} {
+		connectionDetails := map[string]interface{}{
+			"connection_url":       connURL,
+			"revoke_owned_objects": mode,
+		}
+
+		f := New(MetadataLen, MetadataLen, UsernameLen)
+		dbRaw, _ := f()
+		db := dbRaw.(*MySQL)
+
+		if err := db.Initialize(context.Background(), connectionDetails, true); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		statements := dbplugin.Statements{
+			CreationStatements: testMySQLRoleWildCard,
+		}
+
+		usernameConfig := dbplugin.UsernameConfig{
+			DisplayName: "test",
+			RoleName:    "test",
+		}
+
+		username, _, err := db.CreateUser(context.Background(), statements, usernameConfig, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		definer := "DEFINER = '" + username + "'@'%'"
+		for _, query := range []string{
+			"CREATE " + definer + " VIEW vault_owned.v_" + mode + " AS SELECT 1 AS one",
+			"CREATE " + definer + " PROCEDURE vault_owned.p_" + mode + "() SELECT 1",
+		} {
+			if _, err := root.Exec(query); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+
+		if err := db.RevokeUser(context.Background(), statements, username); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		var views, routines int
+		if err := root.QueryRow("SELECT COUNT(*) FROM information_schema.VIEWS WHERE TABLE_SCHEMA = 'vault_owned' AND TABLE_NAME = ?", "v_"+mode).Scan(&views); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := root.QueryRow("SELECT COUNT(*) FROM information_schema.ROUTINES WHERE ROUTINE_SCHEMA = 'vault_owned' AND ROUTINE_NAME = ?", "p_"+mode).Scan(&routines); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		switch mode {
+		case ownedObjectsDrop:
+			if views != 0 || routines != 0 {
+				t.Fatalf("Expected owned objects to be dropped, found %d views and %d routines", views, routines)
+			}
+		case ownedObjectsReassign:
+			if views != 1 || routines != 1 {
+				t.Fatalf("Expected owned objects to be kept, found %d views and %d routines", views, routines)
+			}
+
+			// The objects must still work without their original definer
+			var one int
+			if err := root.QueryRow("SELECT one FROM vault_owned.v_" + mode).Scan(&one); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if _, err := root.Exec("CALL vault_owned.p_" + mode + "()"); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+	}
+}
+
+func TestMySQL_RevokeUser_OwnedObjects_RecreateFails(t *testing.T) {
+	cleanup, connURL := prepareMySQLTestContainer(t)
+	defer cleanup()
+
+	root, err := sql.Open("mysql", connURL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer root.Close()
+
+	// Vault connects as a user that can drop the routine but not create it
+	for _, query := range []string{
+		"CREATE DATABASE IF NOT EXISTS vault_owned",
+		"CREATE USER 'vault_owner'@'%' IDENTIFIED BY 'secret'",
+		"CREATE DEFINER = 'vault_owner'@'%' PROCEDURE vault_owned.p() SELECT 1",
+		"CREATE USER 'vault_limited'@'%' IDENTIFIED BY 'secret'",
+		"GRANT SELECT, CREATE USER ON *.* TO 'vault_limited'@'%'",
+		"GRANT ALTER ROUTINE ON vault_owned.* TO 'vault_limited'@'%'",
+	} {
+		if _, err := root.Exec(query); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	connectionDetails := map[string]interface{}{
+		"connection_url":       strings.Replace(connURL, "root:secret@", "vault_limited:secret@", 1),
+		"revoke_owned_objects": ownedObjectsReassign,
+	}
+
+	f := New(MetadataLen, MetadataLen, UsernameLen)
+	dbRaw, _ := f()
+	db := dbRaw.(*MySQL)
+
+	if err := db.Initialize(context.Background(), connectionDetails, true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = db.RevokeUser(context.Background(), dbplugin.Statements{}, "vault_owner")
+	if err == nil || !strings.Contains(err.Error(), "left in place") {
+		t.Fatalf("Expected the routine to fail to be recreated, got %v", err)
+	}
+
+	// The routine is untouched and the user isn't dropped
+	var definer string
+	if err := root.QueryRow("SELECT DEFINER FROM information_schema.ROUTINES WHERE ROUTINE_SCHEMA = 'vault_owned' AND ROUTINE_NAME = 'p'").Scan(&definer); err != nil {
+		t.Fatalf("Expected the routine to be left in place: %s", err)
+	}
+	if definer != "vault_owner@%" {
+		t.Fatalf("Expected the routine's definer to be unchanged, got %s", definer)
+	}
+	var users int
+	if err := root.QueryRow("SELECT COUNT(*) FROM mysql.user WHERE user = 'vault_owner'").Scan(&users); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if users != 1 {
+		t.Fatalf("Expected the user to be left in place, found %d", users)
+	}
+}
+
+func TestMySQL_routineStatement(t *testing.T) {
+	definition := "CREATE DEFINER=`v-test-test-abc`@`%` PROCEDURE `p`()\nSELECT 1"
+	header := routineHeaderRe.FindStringSubmatchIndex(definition)
+	if header == nil {
+		t.Fatal("Expected the routine header to match")
+	}
+
+	expected := "CREATE DEFINER = CURRENT_USER PROCEDURE `app`.`p`()\nSELECT 1"
+	if actual := routineStatement(definition, header, "CURRENT_USER", "`app`.`p`"); actual != expected {
+		t.Fatalf("Expected %q, got %q", expected, actual)
+	}
+
+	// Restoring the original keeps its definer
+	expected = "CREATE DEFINER = `v-test-test-abc`@`%` PROCEDURE `app`.`p`()\nSELECT 1"
+	if actual := routineStatement(definition, header, definition[header[2]:header[3]], "`app`.`p`"); actual != expected {
+		t.Fatalf("Expected %q, got %q", expected, actual)
+	}
+}
+
+func TestMySQL_quoteIdentifier(t *testing.T) {
+	if actual := quoteIdentifier("we`ird"); actual != "`we``ird`" {
+		t.Fatalf("Unexpected quoted identifier: %s", actual)
+	}
+}
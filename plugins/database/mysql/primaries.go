@@ -0,0 +1,115 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// writePrimary is a writable server, such as another node of a Galera or
+// Group Replication cluster, that users can be created on along with the
+// server at the connection URL.
+type writePrimary struct {
+	ConnectionURL string `json:"connection_url" structs:"connection_url" mapstructure:"connection_url"`
+
+	// Weight is the server's share of the new connections relative to the
+	// others. It defaults to 1.
+	Weight int `json:"weight" structs:"weight" mapstructure:"weight"`
+}
+
+// weightedRoundRobin picks servers in proportion to their weights with the
+// smooth weighted round-robin algorithm, which interleaves the picks of a
+// heavier server with the others rather than making them in a burst.
+type weightedRoundRobin struct {
+	sync.Mutex
+
+	weights []int
+	current []int
+	total   int
+}
+
+func newWeightedRoundRobin(weights []int) *weightedRoundRobin {
+	w := &weightedRoundRobin{
+		weights: weights,
+		current: make([]int, len(weights)),
+	}
+	for _, weight := range weights {
+		w.total += weight
+	}
+
+	return w
+}
+
+// next returns the index of the server to use next.
+func (w *weightedRoundRobin) next() int {
+	w.Lock()
+	defer w.Unlock()
+
+	best := 0
+	for i, weight := range w.weights {
+		w.current[i] += weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+
+	return best
+}
+
+// getPrimaryConnection returns the connection pool of a single write primary,
+// picked by weight, along with its connection URL, so that all of an
+// operation's statements run on the same server. Primaries that can't be
+// reached are skipped. Without write_primaries it is the primary connection.
+func (m *MySQL) getPrimaryConnection(ctx context.Context) (*sql.DB, string, error) {
+	if m.primaries == nil {
+		db, err := m.getConnection(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		return db, m.activeConnectionURL(), nil
+	}
+
+	connURLs := m.connectionURLs()
+	start := m.primaries.next()
+
+	var lastErr error
+	for i := range connURLs {
+		idx := (start + i) % len(connURLs)
+
+		db := m.primaryDB(idx)
+		err := m.withConn(ctx, db, func(conn *sql.Conn) error {
+			return conn.PingContext(ctx)
+		})
+		if err != nil {
+			m.logger.Debug("mysql: write primary unavailable, trying the next", "primary", idx, "error", err)
+			lastErr = err
+			continue
+		}
+		emitPoolMetrics("pool", db)
+
+		return db, connURLs[idx], nil
+	}
+
+	return nil, "", lastErr
+}
+
+// primaryDB returns the connection pool pinned to the write primary at the
+// index of the connection URLs, opening it on first use.
+func (m *MySQL) primaryDB(idx int) *sql.DB {
+	// CreateUser only holds the read lock
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	if m.primaryDBs == nil {
+		m.primaryDBs = make([]*sql.DB, len(m.connectionURLs()))
+	}
+
+	if m.primaryDBs[idx] == nil {
+		db := sql.OpenDB(&mySQLConnector{producer: m.mySQLConnectionProducer, pinned: true, primary: idx})
+		m.ConfigurePool(db)
+		m.primaryDBs[idx] = db
+	}
+
+	return m.primaryDBs[idx]
+}
@@ -0,0 +1,81 @@
+package mysql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMySQL_weightedRoundRobin(t *testing.T) {
+	w := newWeightedRoundRobin([]int{1, 2, 1})
+
+	var picks []int
+	for i := 0; i < 8; i++ {
+		picks = append(picks, w.next())
+	}
+
+	// The heavier server's picks are interleaved with the others
+	expected := []int{1, 0, 2, 1, 1, 0, 2, 1}
+	if !reflect.DeepEqual(picks, expected) {
+		t.Fatalf("Expected %v, got %v", expected, picks)
+	}
+}
+
+func TestMySQL_WritePrimaries(t *testing.T) {
+	f := New(MetadataLen, MetadataLen, UsernameLen)
+	dbRaw, _ := f()
+	db := dbRaw.(*MySQL)
+
+	err := db.Initialize(context.Background(), map[string]interface{}{
+		"connection_url":        "root:secret@tcp(127.0.0.1:1)/mysql",
+		"connection_url_weight": 3,
+		"write_primaries": []map[string]interface{}{
+			{"connection_url": "root:secret@tcp(127.0.0.1:2)/mysql"},
+			{"connection_url": "root:secret@tcp(127.0.0.1:3)/mysql", "weight": 2},
+		},
+	}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	if !reflect.DeepEqual(db.primaries.weights, []int{3, 1, 2}) {
+		t.Fatalf("Unexpected weights %v", db.primaries.weights)
+	}
+
+	expected := []string{
+		"root:secret@tcp(127.0.0.1:1)/mysql",
+		"root:secret@tcp(127.0.0.1:2)/mysql",
+		"root:secret@tcp(127.0.0.1:3)/mysql",
+	}
+	if actual := db.connectionURLs(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	// Every primary is tried before giving up
+	if _, _, err := db.getPrimaryConnection(context.Background()); err == nil {
+		t.Fatal("Expected error with none of the primaries reachable")
+	}
+	for i, primaryDB := range db.primaryDBs {
+		if primaryDB == nil {
+			t.Fatalf("Expected primary %d to have been tried", i)
+		}
+	}
+}
+
+func TestMySQL_WritePrimaries_Invalid(t *testing.T) {
+	for _, conf := range []map[string]interface{}{
+		{"write_primaries": []map[string]interface{}{{"weight": 1}}},
+		{"write_primaries": []map[string]interface{}{{"connection_url": "root:secret@tcp(127.0.0.1:2)/mysql", "weight": -1}}},
+		{"write_primaries": []map[string]interface{}{{"connection_url": "root:secret@tcp(127.0.0.1:2)/mysql"}}, "connection_url_fallbacks": []string{"root:secret@tcp(127.0.0.1:3)/mysql"}},
+		{"write_primaries": []map[string]interface{}{{"connection_url": "not a dsn"}}},
+	} {
+		conf["connection_url"] = "root:secret@tcp(127.0.0.1:1)/mysql"
+
+		f := New(MetadataLen, MetadataLen, UsernameLen)
+		dbRaw, _ := f()
+		if err := dbRaw.(*MySQL).Initialize(context.Background(), conf, false); err == nil {
+			t.Fatalf("Expected error for %v", conf)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package mysql
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	stdmysql "github.com/go-sql-driver/mysql"
+)
+
+const (
+	// proxyNet is the network used in the DSN for connections made through
+	// the dial_proxy.
+	proxyNet = "vault-dial-proxy"
+
+	// proxyIDSeparator separates the server address from the id of the
+	// connection producer in the DSN address, so that the producers' dialers
+	// for the same address are kept apart.
+	proxyIDSeparator = "|"
+
+	defaultProxyDialTimeout = 30 * time.Second
+)
+
+var (
+	// proxyDialers are the dialers for the server addresses reached through
+	// a dial_proxy, by the id of the connection producer they belong to.
+	proxyDialers     = make(map[string]map[string]*proxyDialer)
+	proxyDialersLock sync.RWMutex
+)
+
+func init() {
+	// The driver doesn't synchronize access to its dial functions, so a
+	// single network is registered before any connections are made, which
+	// looks up the proxy for the address being dialed.
+	stdmysql.RegisterDial(proxyNet, dialProxy)
+}
+
+// proxyDialer dials servers through a SOCKS5 proxy, or an HTTP proxy
+// supporting the CONNECT method.
+type proxyDialer struct {
+	proxy   *url.URL
+	timeout time.Duration
+}
+
+// parseDialProxy parses a dial_proxy given as a socks5://, socks5h:// or
+// http:// URL, optionally with a username and password.
+func parseDialProxy(rawURL string) (*url.URL, error) {
+	// The error may contain the password, so it is left out
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dial_proxy, check that reserved characters in the username and password are percent-encoded")
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	default:
+		return nil, fmt.Errorf("invalid dial_proxy scheme %q, must be one of %q, %q or %q", u.Scheme, "socks5", "socks5h", "http")
+	}
+
+	if len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("invalid dial_proxy: missing the host")
+	}
+
+	if len(u.Port()) == 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	return u, nil
+}
+
+// registerProxyDialer routes the producer's connections to the server address
+// through the dialer, and returns the address to use in the DSN. Connections
+// to the address made by the producer use the last dialer registered for it.
+func registerProxyDialer(id, addr string, d *proxyDialer) string {
+	proxyDialersLock.Lock()
+	defer proxyDialersLock.Unlock()
+
+	if proxyDialers[id] == nil {
+		proxyDialers[id] = make(map[string]*proxyDialer)
+	}
+	proxyDialers[id][addr] = d
+
+	// The id follows the port, so that the driver still takes the host of
+	// the address as the TLS server name
+	return addr + proxyIDSeparator + id
+}
+
+// unregisterProxyDialers removes the dialers registered by the producer.
+func unregisterProxyDialers(id string) {
+	proxyDialersLock.Lock()
+	defer proxyDialersLock.Unlock()
+
+	delete(proxyDialers, id)
+}
+
+// dialProxy is the driver's dial function for the proxyNet network.
+func dialProxy(dsnAddr string) (net.Conn, error) {
+	i := strings.LastIndex(dsnAddr, proxyIDSeparator)
+	if i < 0 {
+		return nil, fmt.Errorf("no dial_proxy is configured for %s", dsnAddr)
+	}
+	addr, id := dsnAddr[:i], dsnAddr[i+len(proxyIDSeparator):]
+
+	proxyDialersLock.RLock()
+	d, ok := proxyDialers[id][addr]
+	proxyDialersLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no dial_proxy is configured for %s", addr)
+	}
+
+	return d.dial(addr)
+}
+
+// dial connects to the proxy and asks it to connect to the address. The
+// timeout covers both connecting to the proxy and the proxy connecting to
+// the address.
+func (d *proxyDialer) dial(addr string) (net.Conn, error) {
+	timeout := d.timeout
+	if timeout <= 0 {
+		timeout = defaultProxyDialTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", d.proxy.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to dial_proxy: %s", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if d.proxy.Scheme == "http" {
+		conn, err = d.httpConnect(conn, addr)
+	} else {
+		err = d.socks5Connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s through dial_proxy: %s", addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// socks5Connect performs the SOCKS5 handshake (RFC 1928), authenticating
+// with the username and password of the proxy URL (RFC 1929) if it has them.
+func (d *proxyDialer) socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{0x00}
+	if d.proxy.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if d.proxy.User == nil {
+			return fmt.Errorf("proxy requires a username and password")
+		}
+		username := d.proxy.User.Username()
+		password, _ := d.proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("proxy username and password must be at most 255 bytes")
+		}
+
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("proxy rejected the username and password")
+		}
+	default:
+		return fmt.Errorf("proxy doesn't support any of the offered authentication methods")
+	}
+
+	// Host names are resolved by the proxy, as the server may only be
+	// resolvable from behind it
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("proxy failed to connect with SOCKS reply code %d", header[1])
+	}
+
+	// Discard the bound address and port
+	var boundLen int
+	switch header[3] {
+	case 0x01:
+		boundLen = net.IPv4len
+	case 0x04:
+		boundLen = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLen = int(length[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, boundLen+2))
+	return err
+}
+
+// httpConnect asks the HTTP proxy to tunnel to the address with the CONNECT
+// method, authenticating with the username and password of the proxy URL if
+// it has them.
+func (d *proxyDialer) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		req.SetBasicAuth(d.proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy responded with %s", resp.Status)
+	}
+
+	// The server speaks first, so its greeting may already be buffered
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads from the buffered reader that was used to read the
+// proxy's response before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
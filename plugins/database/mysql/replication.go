@@ -0,0 +1,136 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ReplicationPosition is a point in the server's binary log.
+type ReplicationPosition struct {
+	// File and Position are the binary log coordinates.
+	File     string
+	Position uint64
+
+	// GTIDSet is the set of executed global transaction IDs. It is empty if
+	// GTIDs aren't enabled.
+	GTIDSet string
+}
+
+// replicationPosition returns the server's current binary log position.
+func (m *MySQL) replicationPosition(ctx context.Context, conn *sql.Conn) (*ReplicationPosition, error) {
+	rows, err := conn.QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("binary logging is not enabled")
+	}
+
+	// MySQL reports the executed GTID set as a fifth column, MariaDB only
+	// has the first four.
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(values) < 2 {
+		return nil, fmt.Errorf("unexpected master status with %d columns", len(values))
+	}
+
+	position := &ReplicationPosition{
+		File: values[0].String,
+	}
+	position.Position, err = strconv.ParseUint(values[1].String, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid binary log position %q", values[1].String)
+	}
+	if len(values) >= 5 {
+		position.GTIDSet = values[4].String
+	}
+
+	version, err := m.serverVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if flavor(version) == flavorMariaDB {
+		if err := conn.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_binlog_pos").Scan(&position.GTIDSet); err != nil {
+			return nil, err
+		}
+	}
+
+	return position, nil
+}
+
+// waitForReplica waits until the read_connection_url replica has applied the
+// primary's transactions up to the position, or until the
+// replica_wait_timeout elapses.
+func (m *MySQL) waitForReplica(ctx context.Context, primary *sql.DB, position *ReplicationPosition) error {
+	replica, err := m.getReadConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	var version string
+	err = m.withConn(ctx, primary, func(conn *sql.Conn) error {
+		version, err = m.serverVersion(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// The wait functions take whole seconds
+	timeout := int64(math.Ceil(m.replicaWait.Seconds()))
+
+	// Each reports a timeout as -1, except WAIT_FOR_EXECUTED_GTID_SET which
+	// reports it as 1. NULL is returned if the server isn't replicating.
+	var query string
+	var args []interface{}
+	timedOut := int64(-1)
+	switch {
+	case position.GTIDSet != "" && flavor(version) == flavorMariaDB:
+		query = "SELECT MASTER_GTID_WAIT(?, ?)"
+		args = []interface{}{position.GTIDSet, timeout}
+	case position.GTIDSet != "":
+		query = "SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?)"
+		args = []interface{}{position.GTIDSet, timeout}
+		timedOut = 1
+	default:
+		query = "SELECT MASTER_POS_WAIT(?, ?, ?)"
+		args = []interface{}{position.File, position.Position, timeout}
+	}
+
+	var result sql.NullInt64
+	err = m.withConn(ctx, replica, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, query, args...).Scan(&result)
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !result.Valid:
+		return fmt.Errorf("the replica is not replicating from the primary")
+	case result.Int64 == timedOut:
+		return fmt.Errorf("the replica did not catch up within the replica_wait_timeout of %s", m.replicaWait)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	stdmysql "github.com/go-sql-driver/mysql"
+	"github.com/hashicorp/vault/plugins/helper/database/dbutil"
+)
+
+const (
+	createDatabaseStmt = "CREATE DATABASE {{database | quoteIdentifier}}"
+	databaseGrantStmt  = "GRANT ALL PRIVILEGES ON {{database | quoteIdentifier}}.* TO '{{name}}'@'{{host}}'"
+	dropDatabaseStmt   = "DROP DATABASE IF EXISTS {{database | quoteIdentifier}}"
+
+	// maxDatabaseNameLen is the longest database name MySQL allows.
+	maxDatabaseNameLen = 64
+)
+
+// systemDatabases are the server's own databases, which users must never be
+// given, or have dropped on revocation.
+var systemDatabases = map[string]bool{
+	"mysql":              true,
+	"sys":                true,
+	"information_schema": true,
+	"performance_schema": true,
+}
+
+// databaseName renders the create_database template for the user.
+func (m *MySQL) databaseName(username string) (string, error) {
+	name := dbutil.QueryHelper(m.CreateDatabase, map[string]string{
+		"name": username,
+	})
+	if len(name) > maxDatabaseNameLen {
+		return "", fmt.Errorf("database name %q for create_database is longer than %d characters", name, maxDatabaseNameLen)
+	}
+	if systemDatabases[strings.ToLower(name)] {
+		return "", fmt.Errorf("database name %q for create_database is a system database", name)
+	}
+
+	return name, nil
+}
+
+// createDatabase creates the user's database. It is run on its own rather
+// than with the creation statements, as creating a database implicitly
+// commits the transaction. A database that already exists is never adopted,
+// as the user would be granted, and could have dropped, data that isn't its
+// own.
+func (m *MySQL) createDatabase(ctx context.Context, db *sql.DB, data map[string]string) error {
+	query := renderStatement(createDatabaseStmt, data)
+	m.logger.Debug("mysql: creating database", "statement", query)
+
+	return m.withConn(ctx, db, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, query)
+		// Error 1007: Can't create database; database exists
+		if e, ok := err.(*stdmysql.MySQLError); ok && e.Number == 1007 {
+			return fmt.Errorf("database %q for create_database already exists", data["database"])
+		}
+		return err
+	})
+}
+
+// dropDatabase drops the user's database if it exists.
+func (m *MySQL) dropDatabase(ctx context.Context, db *sql.DB, username string) error {
+	name, err := m.databaseName(username)
+	if err != nil {
+		return err
+	}
+
+	query := renderStatement(dropDatabaseStmt, map[string]string{"database": name})
+	m.logger.Debug("mysql: dropping database", "statement", query)
+
+	return m.withConn(ctx, db, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, query)
+		return err
+	})
+}
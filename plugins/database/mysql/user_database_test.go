@@ -0,0 +1,183 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
+)
+
+func TestMySQL_CreateDatabase(t *testing.T) {
+	cleanup, connURL := prepareMySQLTestContainer(t)
+	defer cleanup()
+
+	connectionDetails := map[string]interface{}{
+		"connection_url":          connURL,
+		"create_database":         "app_{{name}}",
+		"drop_database_on_revoke": true,
+	}
+
+	f := New(MetadataLen, MetadataLen, UsernameLen)
+	dbRaw, _ := f()
+	db := dbRaw.(*MySQL)
+
+	err := db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	statements := dbplugin.Statements{
+		CreationStatements: "CREATE USER '{{name}}'@'%' IDENTIFIED BY '{{password}}'",
+	}
+
+	usernameConfig := dbplugin.UsernameConfig{
+		DisplayName: "test",
+		RoleName:    "test",
+	}
+
+	username, password, err := db.CreateUser(context.Background(), statements, usernameConfig, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The user can create tables in its database
+	conn, err := sql.Open("mysql", strings.Replace(connURL, "root:secret", username+":"+password, 1))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE " + quoteIdentifier("app_"+username) + ".t (id INT)"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := db.RevokeUser(context.Background(), statements, username); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	root, err := sql.Open("mysql", connURL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer root.Close()
+
+	var count int
+	if err := root.QueryRow("SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?", "app_"+username).Scan(&count); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if count != 0 {
+		t.Fatal("Expected the database to be dropped on revocation")
+	}
+}
+
+func TestMySQL_CreateDatabase_Exists(t *testing.T) {
+	cleanup, connURL := prepareMySQLTestContainer(t)
+	defer cleanup()
+
+	connectionDetails := map[string]interface{}{
+		"connection_url":          connURL,
+		"create_database":         "app_{{name}}",
+		"drop_database_on_revoke": true,
+	}
+
+	f := New(MetadataLen, MetadataLen, UsernameLen)
+	dbRaw, _ := f()
+	db := dbRaw.(*MySQL)
+
+	err := db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	root, err := sql.Open("mysql", connURL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer root.Close()
+
+	statements := dbplugin.Statements{
+		CreationStatements: "CREATE USER '{{name}}'@'%' IDENTIFIED BY '{{password}}'",
+	}
+
+	// A database that already exists is not adopted, or dropped
+	if _, err := root.Exec("CREATE DATABASE `app_existing`"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, err = db.CreateUserWithUsername(context.Background(), statements, "existing", time.Now().Add(time.Minute))
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Expected error for an existing database, got %v", err)
+	}
+	if !schemaExists(t, root, "app_existing") {
+		t.Fatal("Expected the existing database to be kept")
+	}
+
+	// The database is dropped if the user can't be created
+	statements.CreationStatements = "CREATE USER '{{name}}'@'%' IDENTIFIED BY '{{password}}'; GRANT SELECT ON nonexistent.* TO 'x'@'%'"
+	_, err = db.CreateUserWithUsername(context.Background(), statements, "failed", time.Now().Add(time.Minute))
+	if err == nil {
+		t.Fatal("Expected error for the failing creation statements")
+	}
+	if schemaExists(t, root, "app_failed") {
+		t.Fatal("Expected the database to be dropped when the user isn't created")
+	}
+}
+
+// schemaExists returns true if the database exists.
+func schemaExists(t *testing.T, db *sql.DB, name string) bool {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?", name).Scan(&count); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return count != 0
+}
+
+func TestMySQL_CreateDatabase_Invalid(t *testing.T) {
+	for _, conf := range []map[string]interface{}{
+		{"create_database": "app"},
+		{"drop_database_on_revoke": true},
+	} {
+		conf["connection_url"] = "root:secret@tcp(127.0.0.1:3306)/mysql"
+
+		f := New(MetadataLen, MetadataLen, UsernameLen)
+		dbRaw, _ := f()
+		if err := dbRaw.(*MySQL).Initialize(context.Background(), conf, false); err == nil {
+			t.Fatalf("Expected error for %v", conf)
+		}
+	}
+}
+
+func TestMySQL_databaseName(t *testing.T) {
+	db := &MySQL{
+		mySQLConnectionProducer: &mySQLConnectionProducer{
+			CreateDatabase: "app_{{name}}",
+		},
+	}
+
+	name, err := db.databaseName("v-test-x")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if name != "app_v-test-x" {
+		t.Fatalf("Unexpected database name %q", name)
+	}
+
+	query := renderStatement(databaseGrantStmt, map[string]string{"database": "app_o`brien", "name": "o'brien", "host": "%"})
+	if query != "GRANT ALL PRIVILEGES ON `app_o``brien`.* TO 'o''brien'@'%'" {
+		t.Fatalf("Unexpected grant %s", query)
+	}
+
+	if _, err := db.databaseName(strings.Repeat("x", 61)); err == nil {
+		t.Fatal("Expected error for a database name longer than 64 characters")
+	}
+
+	db.CreateDatabase = "{{name}}"
+	for _, name := range []string{"mysql", "sys", "INFORMATION_SCHEMA", "performance_schema"} {
+		if _, err := db.databaseName(name); err == nil {
+			t.Fatalf("Expected error for the system database %s", name)
+		}
+	}
+}
@@ -1,29 +1,83 @@
 package connutil
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/vault/helper/parseutil"
 	"github.com/mitchellh/mapstructure"
 )
 
+// ConnectionURLEnvPrefix is the prefix of the environment variables that can
+// be referenced in connection URLs. Anyone able to write the configuration
+// could otherwise send any of the server's environment, such as cloud
+// credentials, to a database host of their choosing.
+const ConnectionURLEnvPrefix = "VAULT_DB_"
+
+// connectionURLFuncs are the functions available in connection URL templates.
+var connectionURLFuncs = template.FuncMap{
+	"env": func(name string) (string, error) {
+		if !strings.HasPrefix(name, ConnectionURLEnvPrefix) {
+			return "", fmt.Errorf("environment variable %q can't be used, only variables starting with %s are allowed", name, ConnectionURLEnvPrefix)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+		return value, nil
+	},
+}
+
+// ExpandConnectionURL renders the environment variables referenced in the
+// connection URL as {{env "VAULT_DB_NAME"}}. This keeps secrets such as the password
+// out of the stored configuration while still reading the current value each
+// time a connection is made.
+func ExpandConnectionURL(connURL string) (string, error) {
+	if !strings.Contains(connURL, "{{") {
+		return connURL, nil
+	}
+
+	tmpl, err := template.New("connection_url").Funcs(connectionURLFuncs).Option("missingkey=error").Parse(connURL)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
 // SQLConnectionProducer implements ConnectionProducer and provides a generic producer for most sql databases
 type SQLConnectionProducer struct {
 	ConnectionURL            string      `json:"connection_url" structs:"connection_url" mapstructure:"connection_url"`
 	MaxOpenConnections       int         `json:"max_open_connections" structs:"max_open_connections" mapstructure:"max_open_connections"`
 	MaxIdleConnections       int         `json:"max_idle_connections" structs:"max_idle_connections" mapstructure:"max_idle_connections"`
 	MaxConnectionLifetimeRaw interface{} `json:"max_connection_lifetime" structs:"max_connection_lifetime" mapstructure:"max_connection_lifetime"`
+	MaxIdleConnectionTimeRaw interface{} `json:"max_idle_connection_time" structs:"max_idle_connection_time" mapstructure:"max_idle_connection_time"`
+
+	Type string
+
+	// Connector, if set, is used to open the database instead of the
+	// connection URL. This allows producers to customize how each individual
+	// connection is established.
+	Connector driver.Connector
 
-	Type                  string
 	maxConnectionLifetime time.Duration
+	maxIdleConnectionTime time.Duration
 	Initialized           bool
 	db                    *sql.DB
-	sync.Mutex
+	sync.RWMutex
 }
 
 func (c *SQLConnectionProducer) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
@@ -35,10 +89,20 @@ func (c *SQLConnectionProducer) Initialize(ctx context.Context, conf map[string]
 		return err
 	}
 
+	// Connections opened with the previous configuration must not be reused
+	if c.db != nil {
+		c.db.Close()
+		c.db = nil
+	}
+
 	if len(c.ConnectionURL) == 0 {
 		return fmt.Errorf("connection_url cannot be empty")
 	}
 
+	if _, err := ExpandConnectionURL(c.ConnectionURL); err != nil {
+		return fmt.Errorf("invalid connection_url: %s", err)
+	}
+
 	if c.MaxOpenConnections == 0 {
 		c.MaxOpenConnections = 2
 	}
@@ -58,6 +122,15 @@ func (c *SQLConnectionProducer) Initialize(ctx context.Context, conf map[string]
 		return fmt.Errorf("invalid max_connection_lifetime: %s", err)
 	}
 
+	if c.MaxIdleConnectionTimeRaw == nil {
+		c.MaxIdleConnectionTimeRaw = "0s"
+	}
+
+	c.maxIdleConnectionTime, err = parseutil.ParseDurationSecond(c.MaxIdleConnectionTimeRaw)
+	if err != nil {
+		return fmt.Errorf("invalid max_idle_connection_time: %s", err)
+	}
+
 	// Set initialized to true at this point since all fields are set,
 	// and the connection can be established at a later time.
 	c.Initialized = true
@@ -97,7 +170,10 @@ func (c *SQLConnectionProducer) Connection(ctx context.Context) (interface{}, er
 	}
 
 	// Otherwise, attempt to make connection
-	conn := c.ConnectionURL
+	conn, err := ExpandConnectionURL(c.ConnectionURL)
+	if err != nil {
+		return nil, err
+	}
 
 	// Ensure timezone is set to UTC for all the conenctions
 	if strings.HasPrefix(conn, "postgres://") || strings.HasPrefix(conn, "postgresql://") {
@@ -108,21 +184,38 @@ func (c *SQLConnectionProducer) Connection(ctx context.Context) (interface{}, er
 		}
 	}
 
-	var err error
-	c.db, err = sql.Open(dbType, conn)
-	if err != nil {
-		return nil, err
+	if c.Connector != nil {
+		c.db = sql.OpenDB(c.Connector)
+	} else {
+		c.db, err = sql.Open(dbType, conn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Set some connection pool settings. We don't need much of this,
-	// since the request rate shouldn't be high.
-	c.db.SetMaxOpenConns(c.MaxOpenConnections)
-	c.db.SetMaxIdleConns(c.MaxIdleConnections)
-	c.db.SetConnMaxLifetime(c.maxConnectionLifetime)
+	c.ConfigurePool(c.db)
+
+	// Make sure the new connection works before handing it out
+	if err := c.db.PingContext(ctx); err != nil {
+		c.db.Close()
+		c.db = nil
+		return nil, err
+	}
 
 	return c.db, nil
 }
 
+// ConfigurePool applies the configured connection pool settings to the pool,
+// so that additional pools opened to the same database behave like the one
+// returned by Connection. We don't need much of this, since the request rate
+// shouldn't be high.
+func (c *SQLConnectionProducer) ConfigurePool(db *sql.DB) {
+	db.SetMaxOpenConns(c.MaxOpenConnections)
+	db.SetMaxIdleConns(c.MaxIdleConnections)
+	db.SetConnMaxLifetime(c.maxConnectionLifetime)
+	db.SetConnMaxIdleTime(c.maxIdleConnectionTime)
+}
+
 // Close attempts to close the connection
 func (c *SQLConnectionProducer) Close() error {
 	// Grab the write lock
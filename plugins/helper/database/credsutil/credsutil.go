@@ -2,6 +2,8 @@ package credsutil
 
 import (
 	"crypto/rand"
+	"encoding/binary"
+	"io"
 	"time"
 
 	"fmt"
@@ -21,8 +23,60 @@ type CredentialsProducer interface {
 const (
 	reqStr    = `A1a-`
 	minStrLen = 10
+
+	// entropyAttempts is how many times reading random bytes is tried before
+	// giving up, as the system's random source may fail transiently.
+	entropyAttempts = 3
 )
 
+var (
+	// randReader is the source of random bytes for passwords and usernames.
+	randReader io.Reader = rand.Reader
+
+	entropyBackoff = 50 * time.Millisecond
+)
+
+// EntropyError is returned when random bytes can't be read from the system's
+// random source, so that no credentials are generated from too little
+// randomness.
+type EntropyError struct {
+	Err error
+}
+
+func (e *EntropyError) Error() string {
+	return fmt.Sprintf("unable to read random bytes after %d attempts: %s", entropyAttempts, e.Err)
+}
+
+// readRandom fills b with random bytes, retrying with a backoff if the
+// random source fails. A partially filled b is never used.
+func readRandom(b []byte) error {
+	var err error
+	for attempt := 0; attempt < entropyAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * entropyBackoff)
+		}
+
+		if _, err = io.ReadFull(randReader, b); err == nil {
+			return nil
+		}
+	}
+
+	return &EntropyError{Err: err}
+}
+
+// randomInt63n returns a random number in [0, n) read from the random source,
+// which unlike math/rand isn't shared with the rest of the process or
+// predictable from its seed.
+func randomInt63n(n int64) (int64, error) {
+	b := make([]byte, 8)
+	if err := readRandom(b); err != nil {
+		return 0, err
+	}
+
+	// The bias of the modulo is negligible for the ranges used
+	return int64(binary.BigEndian.Uint64(b)>>1) % n, nil
+}
+
 // RandomAlphaNumeric returns a random string of characters [A-Za-z0-9-]
 // of the provided length. The string generated takes up to 4 characters
 // of space that are predefined and prepended to ensure password
@@ -48,8 +102,7 @@ func RandomAlphaNumeric(length int, prependA1a bool) (string, error) {
 		// re-roll.
 		c := length + len(reqStr)
 		bArr := make([]byte, c)
-		_, err := rand.Read(bArr)
-		if err != nil {
+		if err := readRandom(bArr); err != nil {
 			return "", err
 		}
 
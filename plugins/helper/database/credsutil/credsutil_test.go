@@ -1,8 +1,14 @@
 package credsutil
 
 import (
+	"crypto/rand"
+	"errors"
+	"io"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
 )
 
 func TestRandomAlphaNumeric(t *testing.T) {
@@ -38,3 +44,457 @@ func TestRandomAlphaNumeric(t *testing.T) {
 		t.Fatalf("Expected %s not to contain %s", s, reqStr)
 	}
 }
+
+// flakyReader fails the first reads, or every read if failures is negative,
+// like a random source that is temporarily unavailable.
+type flakyReader struct {
+	failures int
+}
+
+func (r *flakyReader) Read(b []byte) (int, error) {
+	if r.failures != 0 {
+		r.failures--
+		return 0, errors.New("entropy source unavailable")
+	}
+	return rand.Read(b)
+}
+
+func TestSQLCredentialsProducer_GeneratePassword_Entropy(t *testing.T) {
+	defer func(r io.Reader, backoff time.Duration) {
+		randReader, entropyBackoff = r, backoff
+	}(randReader, entropyBackoff)
+	entropyBackoff = time.Millisecond
+
+	scp := &SQLCredentialsProducer{}
+
+	// Transient failures are retried
+	randReader = &flakyReader{failures: entropyAttempts - 1}
+	password, err := scp.GeneratePassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(password) != defaultPasswordLen {
+		t.Fatalf("Unexpected password %q", password)
+	}
+
+	// No password is returned once the attempts are used up
+	randReader = &flakyReader{failures: -1}
+	password, err = scp.GeneratePassword()
+	if _, ok := err.(*EntropyError); !ok {
+		t.Fatalf("Expected an *EntropyError, got %v", err)
+	}
+	if password != "" {
+		t.Fatalf("Expected no password, got %q", password)
+	}
+}
+
+func TestSQLCredentialsProducer_PasswordPolicy(t *testing.T) {
+	scp := &SQLCredentialsProducer{}
+	err := scp.Configure(map[string]interface{}{
+		"password_policy": map[string]interface{}{
+			"min_length":    "32",
+			"min_uppercase": 1,
+			"min_lowercase": 2,
+			"min_digits":    2,
+			"min_special":   1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	s, err := scp.GeneratePassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(s) != 32 {
+		t.Fatalf("Unexpected length of string, expected 32, got string: %s", s)
+	}
+	if err := scp.PasswordPolicy.Validate(s); err != nil {
+		t.Fatalf("Expected %s to satisfy the password policy: %s", s, err)
+	}
+
+	// A policy that can never be satisfied should return an error
+	scp.PasswordPolicy.MinSpecial = 5
+	if _, err := scp.GeneratePassword(); err == nil {
+		t.Fatal("Expected error when the password policy cannot be satisfied")
+	}
+}
+
+func TestSQLCredentialsProducer_UsernameTemplate(t *testing.T) {
+	scp := &SQLCredentialsProducer{
+		UsernameLen: 32,
+	}
+	err := scp.Configure(map[string]interface{}{
+		"username_template": "app_{{.RoleName}}_{{.RandomString}}",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	s, err := scp.GenerateUsername(dbplugin.UsernameConfig{
+		DisplayName: "token",
+		RoleName:    "readonly",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(s, "app_readonly_") {
+		t.Fatalf("Expected %s to be rendered from the template", s)
+	}
+	if len(s) != 32 {
+		t.Fatalf("Unexpected length of string, expected 32, got string: %s", s)
+	}
+
+	// Rendered usernames must not contain characters that need escaping
+	if _, err := scp.GenerateUsername(dbplugin.UsernameConfig{RoleName: "it's"}); err == nil {
+		t.Fatal("Expected error for a username with invalid characters")
+	}
+
+	if err := scp.Configure(map[string]interface{}{"username_template": "{{.RoleName"}); err == nil {
+		t.Fatal("Expected error for an invalid template")
+	}
+}
+
+func TestSQLCredentialsProducer_UsernamePrefix(t *testing.T) {
+	scp := &SQLCredentialsProducer{
+		DisplayNameLen: 10,
+		RoleNameLen:    10,
+		UsernameLen:    32,
+		Separator:      "-",
+	}
+	err := scp.Configure(map[string]interface{}{
+		"username_prefix": "vault_",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	s, err := scp.GenerateUsername(dbplugin.UsernameConfig{
+		DisplayName: "token",
+		RoleName:    "readonly",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(s, "vault_v-token-readonly-") {
+		t.Fatalf("Expected %s to start with the prefix", s)
+	}
+	if len(s) != 32 {
+		t.Fatalf("Unexpected length of string, expected 32, got string: %s", s)
+	}
+
+	if err := scp.Configure(map[string]interface{}{"username_prefix": "v'"}); err == nil {
+		t.Fatal("Expected error for a prefix with invalid characters")
+	}
+}
+
+func TestSQLCredentialsProducer_UsernameSeparator(t *testing.T) {
+	scp := &SQLCredentialsProducer{
+		DisplayNameLen: 10,
+		RoleNameLen:    10,
+		UsernameLen:    32,
+		Separator:      "-",
+	}
+
+	for separator, prefix := range map[string]string{"_": "v_token_readonly_", "": "vtokenreadonly"} {
+		err := scp.Configure(map[string]interface{}{
+			"username_separator": separator,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		s, err := scp.GenerateUsername(dbplugin.UsernameConfig{
+			DisplayName: "token",
+			RoleName:    "readonly",
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !strings.HasPrefix(s, prefix) {
+			t.Fatalf("Expected %s to start with %s", s, prefix)
+		}
+	}
+
+	// The original separator is restored when it is no longer configured
+	if err := scp.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if scp.Separator != "-" {
+		t.Fatalf("Expected the default separator, got %q", scp.Separator)
+	}
+
+	if err := scp.Configure(map[string]interface{}{"username_separator": "'"}); err == nil {
+		t.Fatal("Expected error for a separator with invalid characters")
+	}
+}
+
+func TestSQLCredentialsProducer_UsernameLength(t *testing.T) {
+	scp := &SQLCredentialsProducer{
+		DisplayNameLen: 10,
+		RoleNameLen:    10,
+		UsernameLen:    32,
+		Separator:      "-",
+	}
+
+	err := scp.Configure(map[string]interface{}{
+		"username_length":     48,
+		"display_name_length": NoneLength,
+		"role_name_length":    4,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	s, err := scp.GenerateUsername(dbplugin.UsernameConfig{
+		DisplayName: "token",
+		RoleName:    "readonly",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(s, "v-read-") || len(s) != len("v-read-")+20+1+10 {
+		t.Fatalf("Expected the configured lengths to be used, got %s", s)
+	}
+
+	// Another producer created with the same lengths is unaffected
+	other := &SQLCredentialsProducer{DisplayNameLen: 10, RoleNameLen: 10, UsernameLen: 32, Separator: "-"}
+	if s, _ := other.GenerateUsername(dbplugin.UsernameConfig{DisplayName: "token", RoleName: "readonly"}); len(s) != 32 {
+		t.Fatalf("Expected a 32 character username, got %s", s)
+	}
+
+	// The original lengths are restored when they are no longer configured
+	if err := scp.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if scp.DisplayNameLen != 10 || scp.RoleNameLen != 10 || scp.UsernameLen != 32 {
+		t.Fatalf("Expected the default lengths, got %d, %d and %d", scp.DisplayNameLen, scp.RoleNameLen, scp.UsernameLen)
+	}
+
+	for _, conf := range []map[string]interface{}{
+		{"username_length": -1},
+		{"display_name_length": -2},
+		{"role_name_length": -2},
+	} {
+		if err := scp.Configure(conf); err == nil {
+			t.Fatalf("Expected error for %v", conf)
+		}
+	}
+}
+
+func TestSQLCredentialsProducer_PasswordLength(t *testing.T) {
+	scp := &SQLCredentialsProducer{}
+
+	if err := scp.Configure(map[string]interface{}{"password_length": 24}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	s, err := scp.GeneratePassword()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(s) != 24 {
+		t.Fatalf("Unexpected length of string, expected 24, got string: %s", s)
+	}
+
+	for _, length := range []int{5, 256} {
+		if err := scp.Configure(map[string]interface{}{"password_length": length}); err == nil {
+			t.Fatalf("Expected error for a password length of %d", length)
+		}
+	}
+
+	err = scp.Configure(map[string]interface{}{
+		"password_length": 24,
+		"password_policy": map[string]interface{}{
+			"min_length": 32,
+		},
+	})
+	if err == nil {
+		t.Fatal("Expected error for a password length shorter than the policy's min_length")
+	}
+}
+
+func TestSQLCredentialsProducer_ExpirationJitter(t *testing.T) {
+	scp := &SQLCredentialsProducer{}
+
+	if err := scp.Configure(map[string]interface{}{"expiration_jitter": 50}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	now := time.Now()
+	ttl := now.Add(100 * time.Second)
+
+	var jittered bool
+	for i := 0; i < 20; i++ {
+		s, err := scp.GenerateExpiration(ttl)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		expiration, err := time.Parse("2006-01-02 15:04:05-0700", s)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		// The format has a resolution of a second
+		if expiration.After(ttl) || expiration.Before(now.Add(49*time.Second)) {
+			t.Fatalf("Expected expiration to be shortened by at most half, got %s", expiration)
+		}
+		if ttl.Sub(expiration) > time.Second {
+			jittered = true
+		}
+	}
+	if !jittered {
+		t.Fatal("Expected expirations to be jittered")
+	}
+
+	// The jitter is read from the random source like passwords are
+	func(r io.Reader, backoff time.Duration) {
+		defer func() {
+			randReader, entropyBackoff = r, backoff
+		}()
+		randReader, entropyBackoff = &flakyReader{failures: -1}, time.Millisecond
+
+		if _, err := scp.GenerateExpiration(ttl); err == nil {
+			t.Fatal("Expected error when the random source fails")
+		}
+	}(randReader, entropyBackoff)
+
+	for _, jitter := range []float64{-1, 100} {
+		if err := scp.Configure(map[string]interface{}{"expiration_jitter": jitter}); err == nil {
+			t.Fatalf("Expected error for an expiration_jitter of %v", jitter)
+		}
+	}
+}
+
+func TestSQLCredentialsProducer_ExpirationFormat(t *testing.T) {
+	ttl := time.Now().Add(36 * time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"", ttl.Format("2006-01-02 15:04:05-0700")},
+		{"timestamp", ttl.Format("2006-01-02 15:04:05-0700")},
+		{"datetime", ttl.UTC().Format("2006-01-02 15:04:05")},
+		{"days", "2"},
+	}
+
+	for _, test := range tests {
+		scp := &SQLCredentialsProducer{}
+		if err := scp.Configure(map[string]interface{}{"expiration_format": test.format}); err != nil {
+			t.Fatalf("Unexpected error for format %q: %s", test.format, err)
+		}
+
+		s, err := scp.GenerateExpiration(ttl)
+		if err != nil {
+			t.Fatalf("Unexpected error for format %q: %s", test.format, err)
+		}
+		if s != test.expected {
+			t.Fatalf("Expected %q for format %q, got %q", test.expected, test.format, s)
+		}
+	}
+
+	// Expirations less than a day away still expire after a day
+	scp := &SQLCredentialsProducer{}
+	if err := scp.Configure(map[string]interface{}{"expiration_format": "days"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s, err := scp.GenerateExpiration(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "1" {
+		t.Fatalf("Expected 1 day, got %q", s)
+	}
+
+	// The days can be counted from when the password was last changed
+	s, err = scp.GenerateExpirationSince(time.Now().Add(36*time.Hour), time.Now().Add(-5*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "7" {
+		t.Fatalf("Expected 7 days, got %q", s)
+	}
+
+	if err := scp.Configure(map[string]interface{}{"expiration_format": "unix"}); err == nil {
+		t.Fatal("Expected error for an unknown expiration_format")
+	}
+}
+
+func TestSQLCredentialsProducer_ExpirationRounding(t *testing.T) {
+	second := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		conf     map[string]interface{}
+		ttl      time.Time
+		expected string
+	}{
+		{map[string]interface{}{}, second.Add(999 * time.Millisecond), "2030-01-01 12:00:00"},
+		{map[string]interface{}{"expiration_rounding": "down"}, second.Add(time.Nanosecond), "2030-01-01 12:00:00"},
+		{map[string]interface{}{"expiration_rounding": "up"}, second, "2030-01-01 12:00:00"},
+		{map[string]interface{}{"expiration_rounding": "up"}, second.Add(time.Nanosecond), "2030-01-01 12:00:01"},
+		{map[string]interface{}{"expiration_rounding": "up"}, second.Add(999 * time.Millisecond), "2030-01-01 12:00:01"},
+		{map[string]interface{}{"expiration_margin": "30s"}, second.Add(500 * time.Millisecond), "2030-01-01 12:00:30"},
+		{map[string]interface{}{"expiration_margin": 90, "expiration_rounding": "up"}, second.Add(500 * time.Millisecond), "2030-01-01 12:01:31"},
+	}
+
+	for _, test := range tests {
+		test.conf["expiration_format"] = "datetime"
+
+		scp := &SQLCredentialsProducer{}
+		if err := scp.Configure(test.conf); err != nil {
+			t.Fatalf("Unexpected error for %v: %s", test.conf, err)
+		}
+
+		s, err := scp.GenerateExpiration(test.ttl)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", test.conf, err)
+		}
+		if s != test.expected {
+			t.Fatalf("Expected %q for %v and %s, got %q", test.expected, test.conf, test.ttl, s)
+		}
+	}
+
+	// The margin can push the expiry into the next day
+	scp := &SQLCredentialsProducer{}
+	if err := scp.Configure(map[string]interface{}{"expiration_format": "days", "expiration_margin": "1h"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s, err := scp.GenerateExpiration(time.Now().Add(24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "2" {
+		t.Fatalf("Expected 2 days, got %q", s)
+	}
+
+	for _, conf := range []map[string]interface{}{
+		{"expiration_rounding": "nearest"},
+		{"expiration_margin": "-1s"},
+		{"expiration_margin": "soon"},
+	} {
+		if err := scp.Configure(conf); err == nil {
+			t.Fatalf("Expected error for %v", conf)
+		}
+	}
+}
+
+func TestSQLCredentialsProducer_ValidateUsername(t *testing.T) {
+	scp := &SQLCredentialsProducer{UsernameLen: 16}
+
+	username, err := scp.ValidateUsername("pod-web-7d9f8b6c5-x2k4q")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if username != "pod-web-7d9f8b6c" {
+		t.Fatalf("Expected the username to be truncated, got %q", username)
+	}
+
+	for _, username := range []string{"", "o'brien", "pod web"} {
+		if _, err := scp.ValidateUsername(username); err == nil {
+			t.Fatalf("Expected error for username %q", username)
+		}
+	}
+}
@@ -1,14 +1,45 @@
 package credsutil
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/mitchellh/mapstructure"
 )
 
 const (
 	NoneLength int = -1
+
+	defaultPasswordLen     = 20
+	maxPasswordLen         = 255
+	passwordPolicyAttempts = 10
+
+	// The formats {{expiration}} can be rendered in, see ExpirationFormat.
+	ExpirationFormatTimestamp = "timestamp"
+	ExpirationFormatDatetime  = "datetime"
+	ExpirationFormatDays      = "days"
+
+	// The ways expirations are rounded to the formats' resolution of a
+	// second, see ExpirationRounding.
+	ExpirationRoundingDown = "down"
+	ExpirationRoundingUp   = "up"
+
+	expirationTimestampLayout = "2006-01-02 15:04:05-0700"
+	expirationDatetimeLayout  = "2006-01-02 15:04:05"
+)
+
+var (
+	// validUsernameRe matches the characters allowed in usernames rendered
+	// from a template, which are safe to use in quoted identifiers.
+	validUsernameRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
 )
 
 // SQLCredentialsProducer implements CredentialsProducer and provides a generic credentials producer for most sql database types.
@@ -17,10 +48,261 @@ type SQLCredentialsProducer struct {
 	RoleNameLen    int
 	UsernameLen    int
 	Separator      string
+
+	PasswordPolicy *PasswordPolicy
+
+	// PasswordLength is the length of generated passwords, a default length
+	// is used if it is zero.
+	PasswordLength int
+
+	// ExpirationJitter is the percentage, up to which generated expirations
+	// are randomly shortened, so that credentials issued together don't all
+	// expire at the same time.
+	ExpirationJitter float64
+
+	// ExpirationFormat is how generated expirations are rendered, as servers
+	// and versions don't agree on what they accept:
+	//
+	//  - timestamp (the default) includes the UTC offset, as PostgreSQL's
+	//    VALID UNTIL expects.
+	//  - datetime is the UTC time without an offset, which is a valid
+	//    DATETIME literal on every MySQL and MariaDB version. Offsets are
+	//    only accepted from MySQL 8.0.19.
+	//  - days is the number of days left, rounded up, for use in
+	//    PASSWORD EXPIRE INTERVAL {{expiration}} DAY on MySQL 5.7.4 and later
+	//    and MariaDB 10.4.3 and later, which have no absolute form.
+	ExpirationFormat string
+
+	// ExpirationRounding is how expirations are rounded to a whole second
+	// when rendered as a timestamp or datetime. Rounding down (the default)
+	// may expire credentials up to a second before their lease, rounding up
+	// never does. The days format is always rounded up.
+	ExpirationRounding string
+
+	// ExpirationMargin is added to expirations, so that credentials remain
+	// valid for a while after their lease ends, for example to allow for the
+	// server's clock being ahead of Vault's. It is added after the jitter.
+	ExpirationMargin time.Duration
+
+	// UsernameTemplate, if set, is used to render usernames instead of the
+	// default layout. It is still truncated to UsernameLen.
+	UsernameTemplate *template.Template
+
+	// UsernamePrefix is prepended to every generated username, so that the
+	// accounts created by Vault can be told apart from others.
+	UsernamePrefix string
+
+	// UsernameMarker follows the leading "v" of generated usernames, so that
+	// plugins which changed how usernames are generated can tell which
+	// scheme an account was created with. It isn't added to templated
+	// usernames.
+	UsernameMarker string
+
+	// defaultSeparator is the Separator the producer was created with, which
+	// is restored when the configuration doesn't override it.
+	defaultSeparator *string
+
+	// defaultLens are the lengths the producer was created with, which are
+	// restored when the configuration doesn't override them.
+	defaultLens *usernameLens
+}
+
+// usernameLens are the lengths display names, role names and usernames are
+// truncated to.
+type usernameLens struct {
+	displayName int
+	roleName    int
+	username    int
+}
+
+// usernameTemplateData is the data available to username templates.
+type usernameTemplateData struct {
+	DisplayName  string
+	RoleName     string
+	RandomString string
+	Timestamp    string
+}
+
+// PasswordPolicy describes the minimum requirements a generated password
+// must satisfy before it is handed out.
+type PasswordPolicy struct {
+	MinLength    int `json:"min_length" structs:"min_length" mapstructure:"min_length"`
+	MinUppercase int `json:"min_uppercase" structs:"min_uppercase" mapstructure:"min_uppercase"`
+	MinLowercase int `json:"min_lowercase" structs:"min_lowercase" mapstructure:"min_lowercase"`
+	MinDigits    int `json:"min_digits" structs:"min_digits" mapstructure:"min_digits"`
+	MinSpecial   int `json:"min_special" structs:"min_special" mapstructure:"min_special"`
+}
+
+// Validate returns an error if the password does not satisfy the policy.
+func (p *PasswordPolicy) Validate(password string) error {
+	var upper, lower, digits, special int
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		case unicode.IsDigit(r):
+			digits++
+		default:
+			special++
+		}
+	}
+
+	switch {
+	case len(password) < p.MinLength:
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	case upper < p.MinUppercase:
+		return fmt.Errorf("password must contain at least %d uppercase characters", p.MinUppercase)
+	case lower < p.MinLowercase:
+		return fmt.Errorf("password must contain at least %d lowercase characters", p.MinLowercase)
+	case digits < p.MinDigits:
+		return fmt.Errorf("password must contain at least %d digits", p.MinDigits)
+	case special < p.MinSpecial:
+		return fmt.Errorf("password must contain at least %d special characters", p.MinSpecial)
+	}
+
+	return nil
+}
+
+// sqlCredentialsConfig holds the optional credentials settings that can be
+// set on the database configuration.
+type sqlCredentialsConfig struct {
+	PasswordPolicy   *PasswordPolicy `json:"password_policy" structs:"password_policy" mapstructure:"password_policy"`
+	UsernameTemplate string          `json:"username_template" structs:"username_template" mapstructure:"username_template"`
+	UsernamePrefix   string          `json:"username_prefix" structs:"username_prefix" mapstructure:"username_prefix"`
+	PasswordLength   int             `json:"password_length" structs:"password_length" mapstructure:"password_length"`
+	ExpirationJitter float64         `json:"expiration_jitter" structs:"expiration_jitter" mapstructure:"expiration_jitter"`
+	ExpirationFormat string          `json:"expiration_format" structs:"expiration_format" mapstructure:"expiration_format"`
+
+	ExpirationRounding  string      `json:"expiration_rounding" structs:"expiration_rounding" mapstructure:"expiration_rounding"`
+	ExpirationMarginRaw interface{} `json:"expiration_margin" structs:"expiration_margin" mapstructure:"expiration_margin"`
+
+	// UsernameSeparator is a pointer so that an empty separator can be told
+	// apart from an unset one.
+	UsernameSeparator *string `json:"username_separator" structs:"username_separator" mapstructure:"username_separator"`
+
+	// The lengths override the ones the producer was created with if they
+	// are not zero. Display and role names are left out of usernames if
+	// their length is NoneLength.
+	UsernameLength    int `json:"username_length" structs:"username_length" mapstructure:"username_length"`
+	DisplayNameLength int `json:"display_name_length" structs:"display_name_length" mapstructure:"display_name_length"`
+	RoleNameLength    int `json:"role_name_length" structs:"role_name_length" mapstructure:"role_name_length"`
+}
+
+// Configure parses the optional credentials settings out of the provided
+// database configuration.
+func (scp *SQLCredentialsProducer) Configure(conf map[string]interface{}) error {
+	config := &sqlCredentialsConfig{}
+	if err := mapstructure.WeakDecode(conf, config); err != nil {
+		return err
+	}
+
+	scp.PasswordPolicy = config.PasswordPolicy
+
+	if config.PasswordLength != 0 && (config.PasswordLength < minStrLen || config.PasswordLength > maxPasswordLen) {
+		return fmt.Errorf("password_length must be between %d and %d", minStrLen, maxPasswordLen)
+	}
+	if config.PasswordLength != 0 && config.PasswordPolicy != nil && config.PasswordPolicy.MinLength > config.PasswordLength {
+		return fmt.Errorf("password_length %d is shorter than the password policy's min_length %d", config.PasswordLength, config.PasswordPolicy.MinLength)
+	}
+	scp.PasswordLength = config.PasswordLength
+
+	if config.ExpirationJitter < 0 || config.ExpirationJitter >= 100 {
+		return fmt.Errorf("expiration_jitter must be a percentage of at least 0 and less than 100")
+	}
+	scp.ExpirationJitter = config.ExpirationJitter
+
+	switch config.ExpirationFormat {
+	case "", ExpirationFormatTimestamp, ExpirationFormatDatetime, ExpirationFormatDays:
+	default:
+		return fmt.Errorf("expiration_format must be one of %q, %q or %q", ExpirationFormatTimestamp, ExpirationFormatDatetime, ExpirationFormatDays)
+	}
+	scp.ExpirationFormat = config.ExpirationFormat
+
+	switch config.ExpirationRounding {
+	case "", ExpirationRoundingDown, ExpirationRoundingUp:
+	default:
+		return fmt.Errorf("expiration_rounding must be one of %q or %q", ExpirationRoundingDown, ExpirationRoundingUp)
+	}
+	scp.ExpirationRounding = config.ExpirationRounding
+
+	if config.ExpirationMarginRaw == nil {
+		config.ExpirationMarginRaw = "0s"
+	}
+	margin, err := parseutil.ParseDurationSecond(config.ExpirationMarginRaw)
+	if err != nil {
+		return fmt.Errorf("invalid expiration_margin: %s", err)
+	}
+	if margin < 0 {
+		return fmt.Errorf("expiration_margin must not be negative")
+	}
+	scp.ExpirationMargin = margin
+
+	if config.UsernamePrefix != "" && !validUsernameRe.MatchString(config.UsernamePrefix) {
+		return fmt.Errorf("username_prefix %q contains invalid characters", config.UsernamePrefix)
+	}
+	scp.UsernamePrefix = config.UsernamePrefix
+
+	if scp.defaultSeparator == nil {
+		separator := scp.Separator
+		scp.defaultSeparator = &separator
+	}
+	scp.Separator = *scp.defaultSeparator
+	if config.UsernameSeparator != nil {
+		separator := *config.UsernameSeparator
+		if separator != "" && !validUsernameRe.MatchString(separator) {
+			return fmt.Errorf("username_separator %q contains invalid characters", separator)
+		}
+		scp.Separator = separator
+	}
+
+	if scp.defaultLens == nil {
+		scp.defaultLens = &usernameLens{
+			displayName: scp.DisplayNameLen,
+			roleName:    scp.RoleNameLen,
+			username:    scp.UsernameLen,
+		}
+	}
+	switch {
+	case config.UsernameLength < 0:
+		return fmt.Errorf("username_length must not be negative")
+	case config.DisplayNameLength < NoneLength:
+		return fmt.Errorf("display_name_length must be at least %d", NoneLength)
+	case config.RoleNameLength < NoneLength:
+		return fmt.Errorf("role_name_length must be at least %d", NoneLength)
+	}
+	scp.DisplayNameLen = lenOrDefault(config.DisplayNameLength, scp.defaultLens.displayName)
+	scp.RoleNameLen = lenOrDefault(config.RoleNameLength, scp.defaultLens.roleName)
+	scp.UsernameLen = lenOrDefault(config.UsernameLength, scp.defaultLens.username)
+
+	scp.UsernameTemplate = nil
+	if config.UsernameTemplate != "" {
+		tmpl, err := template.New("username").Option("missingkey=error").Parse(config.UsernameTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid username_template: %s", err)
+		}
+		scp.UsernameTemplate = tmpl
+	}
+
+	return nil
+}
+
+// lenOrDefault returns the configured length, or the default if it is zero.
+func lenOrDefault(configured, def int) int {
+	if configured == 0 {
+		return def
+	}
+
+	return configured
 }
 
 func (scp *SQLCredentialsProducer) GenerateUsername(config dbplugin.UsernameConfig) (string, error) {
-	username := "v"
+	if scp.UsernameTemplate != nil {
+		return scp.generateTemplatedUsername(config)
+	}
+
+	username := "v" + scp.UsernameMarker
 
 	displayName := config.DisplayName
 	if scp.DisplayNameLen > 0 && len(displayName) > scp.DisplayNameLen {
@@ -51,6 +333,7 @@ func (scp *SQLCredentialsProducer) GenerateUsername(config dbplugin.UsernameConf
 
 	username = fmt.Sprintf("%s%s%s", username, scp.Separator, userUUID)
 	username = fmt.Sprintf("%s%s%s", username, scp.Separator, fmt.Sprint(time.Now().UTC().Unix()))
+	username = scp.UsernamePrefix + username
 	if scp.UsernameLen > 0 && len(username) > scp.UsernameLen {
 		username = username[:scp.UsernameLen]
 	}
@@ -58,15 +341,124 @@ func (scp *SQLCredentialsProducer) GenerateUsername(config dbplugin.UsernameConf
 	return username, nil
 }
 
-func (scp *SQLCredentialsProducer) GeneratePassword() (string, error) {
-	password, err := RandomAlphaNumeric(20, true)
+func (scp *SQLCredentialsProducer) generateTemplatedUsername(config dbplugin.UsernameConfig) (string, error) {
+	randomString, err := RandomAlphaNumeric(20, false)
 	if err != nil {
 		return "", err
 	}
 
-	return password, nil
+	data := usernameTemplateData{
+		DisplayName:  config.DisplayName,
+		RoleName:     config.RoleName,
+		RandomString: randomString,
+		Timestamp:    fmt.Sprint(time.Now().UTC().Unix()),
+	}
+
+	var buf bytes.Buffer
+	if err := scp.UsernameTemplate.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering username_template: %s", err)
+	}
+
+	username := scp.UsernamePrefix + buf.String()
+	if scp.UsernameLen > 0 && len(username) > scp.UsernameLen {
+		username = username[:scp.UsernameLen]
+	}
+
+	if !validUsernameRe.MatchString(username) {
+		return "", fmt.Errorf("username %q rendered from username_template contains invalid characters", username)
+	}
+
+	return username, nil
+}
+
+// ValidateUsername checks a username supplied by the caller, rather than
+// generated, and returns it truncated to UsernameLen.
+func (scp *SQLCredentialsProducer) ValidateUsername(username string) (string, error) {
+	if scp.UsernameLen > 0 && len(username) > scp.UsernameLen {
+		username = username[:scp.UsernameLen]
+	}
+
+	if !validUsernameRe.MatchString(username) {
+		return "", fmt.Errorf("username %q is empty or contains invalid characters", username)
+	}
+
+	return username, nil
+}
+
+func (scp *SQLCredentialsProducer) GeneratePassword() (string, error) {
+	length := defaultPasswordLen
+	if scp.PasswordLength > 0 {
+		length = scp.PasswordLength
+	}
+
+	if scp.PasswordPolicy == nil {
+		return RandomAlphaNumeric(length, true)
+	}
+
+	if scp.PasswordPolicy.MinLength > length {
+		length = scp.PasswordPolicy.MinLength
+	}
+
+	// Regenerate the password until it satisfies the policy, giving up after a
+	// bounded number of attempts.
+	var lastErr error
+	for i := 0; i < passwordPolicyAttempts; i++ {
+		password, err := RandomAlphaNumeric(length, true)
+		if err != nil {
+			return "", err
+		}
+
+		lastErr = scp.PasswordPolicy.Validate(password)
+		if lastErr == nil {
+			return password, nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to generate a password satisfying the password policy after %d attempts: %s", passwordPolicyAttempts, lastErr)
 }
 
 func (scp *SQLCredentialsProducer) GenerateExpiration(ttl time.Time) (string, error) {
-	return ttl.Format("2006-01-02 15:04:05-0700"), nil
+	return scp.GenerateExpirationSince(ttl, time.Now())
+}
+
+// GenerateExpirationSince generates the expiration like GenerateExpiration,
+// except that the days format counts the days from since rather than from
+// now, for servers that count a password's lifetime from when it was last
+// changed.
+func (scp *SQLCredentialsProducer) GenerateExpirationSince(ttl, since time.Time) (string, error) {
+	if scp.ExpirationJitter > 0 {
+		if remaining := time.Until(ttl); remaining > 0 {
+			window := int64(float64(remaining) * scp.ExpirationJitter / 100)
+			if window > 0 {
+				jitter, err := randomInt63n(window)
+				if err != nil {
+					return "", err
+				}
+				ttl = ttl.Add(-time.Duration(jitter))
+			}
+		}
+	}
+
+	ttl = ttl.Add(scp.ExpirationMargin)
+
+	// The formats are truncated to the second
+	if scp.ExpirationRounding == ExpirationRoundingUp {
+		if truncated := ttl.Truncate(time.Second); truncated.Before(ttl) {
+			ttl = truncated.Add(time.Second)
+		}
+	}
+
+	switch scp.ExpirationFormat {
+	case ExpirationFormatDatetime:
+		return ttl.UTC().Format(expirationDatetimeLayout), nil
+	case ExpirationFormatDays:
+		// The server can't expire a password sooner than a day
+		days := int64(math.Ceil(ttl.Sub(since).Hours() / 24))
+		if days < 1 {
+			days = 1
+		}
+		return strconv.FormatInt(days, 10), nil
+	default:
+		return ttl.Format(expirationTimestampLayout), nil
+	}
 }
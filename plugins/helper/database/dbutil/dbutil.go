@@ -3,13 +3,32 @@ package dbutil
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 )
 
 var (
 	ErrEmptyCreationStatement = errors.New("empty creation statements")
+
+	// placeholderRe matches {{key}} and {{key | function}} placeholders.
+	placeholderRe = regexp.MustCompile(`\{\{(\w+)(?:\s*\|\s*(\w+)\s*)?\}\}`)
 )
 
+// QueryFuncs are the functions that can be applied to values in templates,
+// such as {{name | quoteIdentifier}}, by name.
+type QueryFuncs map[string]func(string) string
+
+// ConfigError wraps an error caused by the database configuration, such as
+// invalid credentials, which will keep failing until the configuration is
+// updated and so should not be retried.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid database configuration: %s", e.Err)
+}
+
 // Query templates a query for us.
 func QueryHelper(tpl string, data map[string]string) string {
 	for k, v := range data {
@@ -18,3 +37,31 @@ func QueryHelper(tpl string, data map[string]string) string {
 
 	return tpl
 }
+
+// QueryHelperFuncs templates a query, applying the named function to the
+// raw value of each {{key | function}} placeholder and escape, if not nil,
+// to the value of each plain {{key}} placeholder. Placeholders are replaced
+// in a single pass, so values are never templated themselves, and those
+// with unknown keys or functions are left as they are.
+func QueryHelperFuncs(tpl string, data map[string]string, escape func(string) string, funcs QueryFuncs) string {
+	return placeholderRe.ReplaceAllStringFunc(tpl, func(placeholder string) string {
+		match := placeholderRe.FindStringSubmatch(placeholder)
+		v, ok := data[match[1]]
+		if !ok {
+			return placeholder
+		}
+
+		if len(match[2]) > 0 {
+			f, ok := funcs[match[2]]
+			if !ok {
+				return placeholder
+			}
+			return f(v)
+		}
+
+		if escape != nil {
+			return escape(v)
+		}
+		return v
+	})
+}
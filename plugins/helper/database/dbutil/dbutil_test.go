@@ -0,0 +1,39 @@
+package dbutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryHelperFuncs(t *testing.T) {
+	data := map[string]string{
+		"name":     "v-role-x",
+		"password": "{{name}}",
+	}
+	funcs := QueryFuncs{
+		"upper": strings.ToUpper,
+	}
+
+	cases := map[string]string{
+		"{{name}}":                "[v-role-x]",
+		"{{name | upper}}":        "V-ROLE-X",
+		"{{name|upper}}":          "V-ROLE-X",
+		"{{password}}":            "[{{name}}]",
+		"{{password | upper}}":    "{{NAME}}",
+		"{{name | unknown}}":      "{{name | unknown}}",
+		"{{missing}}":             "{{missing}}",
+		"{{missing | upper}}":     "{{missing | upper}}",
+		"GRANT {{name}} {{name}}": "GRANT [v-role-x] [v-role-x]",
+	}
+
+	for tpl, expected := range cases {
+		actual := QueryHelperFuncs(tpl, data, func(v string) string { return "[" + v + "]" }, funcs)
+		if actual != expected {
+			t.Fatalf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+
+	if actual := QueryHelperFuncs("{{name}}", data, nil, nil); actual != "v-role-x" {
+		t.Fatalf("Expected the value unescaped without an escape function, got %q", actual)
+	}
+}
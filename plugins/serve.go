@@ -2,12 +2,20 @@ package plugins
 
 import (
 	"fmt"
+	"os"
 
+	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
 	"github.com/hashicorp/vault/helper/pluginutil"
 )
 
+// loggerSetter is implemented by plugins that log. Serve configures them with
+// a logger whose output the plugin client forwards to Vault's log.
+type loggerSetter interface {
+	SetLogger(logger hclog.Logger)
+}
+
 // Serve is used to start a plugin's RPC server. It takes an interface that must
 // implement a known plugin interface to vault and an optional api.TLSConfig for
 // use during the inital unwrap request to vault. The api config is particulary
@@ -21,6 +29,17 @@ func Serve(plugin interface{}, tlsConfig *api.TLSConfig) {
 		return
 	}
 
+	// The plugin client parses JSON log lines written to stderr and re-emits
+	// them at their original level, so let Vault's log level do the
+	// filtering.
+	if l, ok := plugin.(loggerSetter); ok {
+		l.SetLogger(hclog.New(&hclog.LoggerOptions{
+			Level:      hclog.Trace,
+			Output:     os.Stderr,
+			JSONFormat: true,
+		}))
+	}
+
 	switch p := plugin.(type) {
 	case dbplugin.Database:
 		dbplugin.Serve(p, tlsProvider)